@@ -0,0 +1,269 @@
+package filebuf
+
+/* Backing files
+   Pieces of a buffer opened with OpenFile refer to the file on disk, they
+   don't hold a copy of the data. If somebody else changes that file, the
+   buffer silently changes along with it. To at least notice that, we
+   remember the identity, size and mtime (and optionally a hash) of every
+   backing file, so they can be checked, watched and reloaded.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//CheckBacking returns an error wrapping this if a backing file changed on disk
+var ErrBackingChanged = errors.New("filebuf: backing file changed on disk")
+
+//a file on disk that (part of) the buffer is read from
+type backing struct {
+	path  string      //absolute path
+	file  io.ReaderAt //what the fileData pieces refer to
+	info  os.FileInfo //to check if path still refers to the same file
+	size  int64       //size of the file on disk
+	mtime time.Time
+	hash  []byte   //sha256 of the contents, if asked for
+	lock  LockMode //lock held on file
+
+	format Compression //how the file is compressed
+	length int64       //size of the (decompressed) data in file
+}
+
+func mkBacking(path string, file io.ReaderAt, hash bool) (*backing, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	b := &backing{path: abs, file: file, info: info, size: info.Size(), mtime: info.ModTime(), length: info.Size()}
+	if hash {
+		if b.hash, err = hashFile(abs); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+//is d a piece of this backing file?
+func (b *backing) owns(d data) bool {
+	f, _, ok := fileSource(d)
+	return ok && f == b.file
+}
+
+//does the file on disk still look like it did when we opened it?
+func (b *backing) check() error {
+	info, err := os.Stat(b.path)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: %s: %v", ErrBackingChanged, b.path, err)
+	case !os.SameFile(b.info, info):
+		return fmt.Errorf("%w: %s was replaced", ErrBackingChanged, b.path)
+	case info.Size() != b.size:
+		return fmt.Errorf("%w: %s changed size (%d -> %d)", ErrBackingChanged, b.path, b.size, info.Size())
+	case !info.ModTime().Equal(b.mtime):
+		return fmt.Errorf("%w: %s was modified", ErrBackingChanged, b.path)
+	}
+	if b.hash != nil {
+		h, err := hashFile(b.path)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrBackingChanged, b.path, err)
+		}
+		if !bytes.Equal(h, b.hash) {
+			return fmt.Errorf("%w: contents of %s changed", ErrBackingChanged, b.path)
+		}
+	}
+	return nil
+}
+
+//CheckBacking checks if the files that fb was opened from changed on disk
+//The returned error wraps ErrBackingChanged and names the file and what changed.
+func (fb *Buffer) CheckBacking() error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	for _, b := range fb.backing {
+		if err := b.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Reload opens the backing files of fb again and re-reads them
+//If reapply is false, all edits are discarded and fb holds the new contents.
+//Otherwise the edits are applied again on top of the new contents as a patch:
+//ranges of the old file are read from the same offset in the new file (cut short
+//if the file shrunk) and inserted data stays where it was.
+//The old files are closed, other buffers that share pieces of them with fb
+//(made with Copy or Cut) can't be read after this.
+func (fb *Buffer) Reload(reapply bool) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if len(fb.backing) == 0 {
+		return errors.New("filebuf: buffer has no backing file to reload")
+	}
+
+	nb := make([]*backing, len(fb.backing))
+	for i, b := range fb.backing {
+		var err error
+		if nb[i], err = b.reopen(b.format); err != nil {
+			return err
+		}
+	}
+
+	var pieces []data
+	if reapply {
+		fb.root.iter(func(n *node) bool {
+			d := n.data
+			for i, b := range fb.backing {
+				if b.owns(d) {
+					_, off, _ := fileSource(d)
+					d = nb[i].slice(off, d.Size())
+					break
+				}
+			}
+			if d.Size() > 0 {
+				pieces = append(pieces, d)
+			}
+			return false
+		})
+	} else {
+		for _, b := range nb {
+			pieces = append(pieces, b.contents()...)
+		}
+	}
+	fb.setPieces(pieces)
+	for _, b := range fb.backing {
+		fb.crcs.forget(b.file)
+	}
+	fb.retire(fb.backing)
+	fb.backing = nb
+	if fb.watcher != nil {
+		fb.watcher.add(nb)
+	}
+	if fb.journal != nil {
+		return fb.journal.reset(fb)
+	}
+	return nil
+}
+
+//open the file at b.path again, with the same lock and hashing as b
+//format is what the file is now (it might have been saved in another format).
+//the lock on b is handed over to the new backing file
+func (b *backing) reopen(format Compression) (*backing, error) {
+	var r io.ReaderAt
+	length := int64(-1)
+	if format == NoCompression {
+		d, err := mkFileBuf(b.path)
+		if err != nil {
+			return nil, err
+		}
+		r = d.file
+	} else {
+		s, err := openSeekable(b.path)
+		if err != nil {
+			return nil, err
+		}
+		r, length = s, s.size
+	}
+	nb, err := mkBacking(b.path, r, b.hash != nil)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	nb.format = format
+	if length >= 0 {
+		nb.length = length
+	}
+	//flock locks conflict between our own file handles too
+	mode := b.lock
+	b.unlock()
+	if err = nb.lockAs(mode); err != nil {
+		closeReader(r)
+		b.lockAs(mode)
+		return nil, err
+	}
+	return nb, nil
+}
+
+//the same range as f, but in this backing file (cut short if it doesn't fit)
+func (b *backing) slice(off, size int64) *fileData {
+	d := &fileData{file: b.file, offset: off, size: size}
+	if d.offset > b.length {
+		d.offset = b.length
+	}
+	if d.offset+d.size > b.length {
+		d.size = b.length - d.offset
+	}
+	return d
+}
+
+//the pieces holding all data of b, holes in the file are zero fill pieces
+func (b *backing) contents() []data {
+	if b.format != NoCompression {
+		return []data{&fileData{file: b.file, size: b.length}}
+	}
+	return sparsePieces(b.file, b.length)
+}
+
+//replace the tree of fb
+func (fb *Buffer) setPieces(pieces []data) {
+	fb.root = mkTree(pieces)
+	if fb.root == nil {
+		fb.root = mkNode(mkBuf([]byte{}))
+	}
+	if fb.offset > fb.size() {
+		fb.offset = fb.size()
+	}
+}
+
+//close the files of backing files fb doesn't use anymore
+//Files that the edit script being recorded still reads from stay open until Close.
+func (fb *Buffer) retire(old []*backing) {
+	used := make(map[io.ReaderAt]bool)
+	mark := func(t *node) {
+		t.iter(func(n *node) bool {
+			if f, _, ok := fileSource(n.data); ok {
+				used[f] = true
+			}
+			return false
+		})
+	}
+	mark(fb.root)
+	if fb.script != nil {
+		for _, e := range fb.script.edits {
+			if e.tree != nil {
+				mark(e.tree.root)
+			}
+		}
+	}
+	for _, b := range old {
+		if used[b.file] {
+			fb.retired = append(fb.retired, b.file)
+		} else {
+			closeReader(b.file)
+		}
+	}
+}
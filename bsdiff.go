@@ -0,0 +1,253 @@
+package filebuf
+
+/* bsdiff patches (BSDIFF40)
+   A header with the sizes of three bzip2 compressed blocks and the new size:
+   - control: triples (x, y, z): add x diff bytes to x bytes of old, copy y
+     extra bytes, then seek z bytes in old
+   - diff: the bytes to add, mostly zeroes
+   - extra: new bytes
+   Runs of zero diff bytes are copies of old and become pieces of it.
+   The standard library only reads bzip2, dsnet/compress writes it.
+*/
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	bz2 "github.com/dsnet/compress/bzip2"
+)
+
+var bsdiffMagic = []byte("BSDIFF40")
+
+//the diff bytes are read in chunks of this
+const bsdiffChunk = 1 << 20
+
+func applyBSDiff(orig *Buffer, r io.Reader) (*Buffer, error) {
+	hdr, err := patchBytes(r, 32)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:8], bsdiffMagic) {
+		return nil, fmt.Errorf("%w: not a bsdiff patch", ErrBadPatch)
+	}
+	ctrlLen, diffLen, newSize := offtin(hdr[8:]), offtin(hdr[16:]), offtin(hdr[24:])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 {
+		return nil, fmt.Errorf("%w: negative size in header", ErrBadPatch)
+	}
+	ctrlz, err := patchBytes(r, ctrlLen)
+	if err != nil {
+		return nil, err
+	}
+	diffz, err := patchBytes(r, diffLen)
+	if err != nil {
+		return nil, err
+	}
+	ctrl := bzip2.NewReader(bytes.NewReader(ctrlz))
+	diffs := bzip2.NewReader(bytes.NewReader(diffz))
+	extra := bzip2.NewReader(r)
+
+	b := mkBuilder()
+	var oldpos int64
+	for b.size() < newSize {
+		triple, err := patchBytes(ctrl, 24)
+		if err != nil {
+			return nil, err
+		}
+		x, y, z := offtin(triple), offtin(triple[8:]), offtin(triple[16:])
+		if x < 0 || y < 0 || b.size()+x+y > newSize {
+			return nil, fmt.Errorf("%w: bad control (%d, %d, %d)", ErrBadPatch, x, y, z)
+		}
+		for done := int64(0); done < x; {
+			d, err := patchBytes(diffs, minInt64(x-done, bsdiffChunk))
+			if err != nil {
+				return nil, err
+			}
+			if err := bsdiffAdd(b, orig, oldpos+done, d); err != nil {
+				return nil, err
+			}
+			done += int64(len(d))
+		}
+		e, err := patchBytes(extra, y)
+		if err != nil {
+			return nil, err
+		}
+		b.add(e)
+		oldpos += x + z
+	}
+	return b.out, nil
+}
+
+//append the bytes of orig at off plus d
+//runs of zeroes in d that are in orig are copies
+func bsdiffAdd(b *builder, orig *Buffer, off int64, d []byte) error {
+	inOrig := func(i, j int) bool {
+		return off+int64(i) >= 0 && off+int64(j) <= orig.size()
+	}
+	for i := 0; i < len(d); {
+		//the end of the zero run at i, or of the bytes before the next long run
+		j := i
+		for j < len(d) && d[j] == 0 {
+			j++
+		}
+		if j-i >= smallCopy && inOrig(i, j) {
+			if err := b.copy(orig, off+int64(i), int64(j-i)); err != nil {
+				return err
+			}
+			i = j
+			continue
+		}
+		for run := 0; j < len(d); j++ {
+			if d[j] != 0 {
+				run = 0
+			} else if run++; run == smallCopy {
+				j -= smallCopy - 1
+				break
+			}
+		}
+		p, err := paddedBytes(orig, off+int64(i), int64(j-i))
+		if err != nil {
+			return err
+		}
+		for k := range p {
+			p[k] += d[i+k]
+		}
+		b.add(p)
+		i = j
+	}
+	return nil
+}
+
+//n bytes of fb at off, zeroes where that's outside of fb (like bspatch does)
+func paddedBytes(fb *Buffer, off, n int64) ([]byte, error) {
+	p := make([]byte, n)
+	start, end := off, off+n
+	if start < 0 {
+		start = 0
+	}
+	if end > fb.size() {
+		end = fb.size()
+	}
+	if start < end {
+		q, err := fb.bytes(start, end-start)
+		if err != nil {
+			return nil, err
+		}
+		copy(p[start-off:], q)
+	}
+	return p, nil
+}
+
+type bsdiffCtrl struct {
+	x, y, z int64
+}
+
+//the control is made from the diff: equal ranges have diff bytes of zero,
+//inserted ranges are extra bytes
+func makeBSDiff(old, new *Buffer, steps []DiffRange) ([]byte, error) {
+	var ctrls []bsdiffCtrl
+	var extra bytes.Buffer
+	cur := bsdiffCtrl{}
+	var curOld int64 //where cur starts in old
+	for _, st := range steps {
+		switch st.Op {
+		case DiffEqual:
+			if cur.y == 0 && curOld+cur.x == st.A {
+				cur.x += st.Size
+				continue
+			}
+			cur.z = st.A - (curOld + cur.x)
+			ctrls = append(ctrls, cur)
+			cur, curOld = bsdiffCtrl{x: st.Size}, st.A
+		case DiffInsert:
+			p, err := new.bytes(st.B, st.Size)
+			if err != nil {
+				return nil, err
+			}
+			extra.Write(p)
+			cur.y += st.Size
+		}
+	}
+	if cur.x > 0 || cur.y > 0 {
+		ctrls = append(ctrls, cur)
+	}
+
+	var ctrl, diffs bytes.Buffer
+	for _, c := range ctrls {
+		ctrl.Write(offtout(c.x))
+		ctrl.Write(offtout(c.y))
+		ctrl.Write(offtout(c.z))
+	}
+	ctrlz, err := bz2Compress(&ctrl)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := newBz2Writer(&diffs)
+	if err != nil {
+		return nil, err
+	}
+	zeroes := make([]byte, 64*1024)
+	for _, c := range ctrls {
+		for n := c.x; n > 0; n -= int64(len(zeroes)) {
+			zw.Write(zeroes[:minInt64(n, int64(len(zeroes)))])
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	extraz, err := bz2Compress(&extra)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(bsdiffMagic)
+	out.Write(offtout(int64(len(ctrlz))))
+	out.Write(offtout(int64(diffs.Len())))
+	out.Write(offtout(new.size()))
+	out.Write(ctrlz)
+	out.Write(diffs.Bytes())
+	out.Write(extraz)
+	return out.Bytes(), nil
+}
+
+func newBz2Writer(w io.Writer) (*bz2.Writer, error) {
+	return bz2.NewWriter(w, &bz2.WriterConfig{Level: bz2.BestCompression})
+}
+
+func bz2Compress(r io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	zw, err := newBz2Writer(&out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+//bsdiff's integers: 8 bytes little endian, sign and magnitude
+func offtin(b []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+func offtout(x int64) []byte {
+	b := make([]byte, 8)
+	if x < 0 {
+		binary.LittleEndian.PutUint64(b, uint64(-x))
+		b[7] |= 0x80
+	} else {
+		binary.LittleEndian.PutUint64(b, uint64(x))
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+package filebuf
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+//a least-recently-used cache of blocks, keyed by block number
+type blockCache struct {
+	max   int
+	items map[int64]*list.Element
+	order *list.List //front is most recently used
+}
+
+type cacheEntry struct {
+	key  int64
+	data []byte
+}
+
+func mkBlockCache(max int) *blockCache {
+	if max < 1 {
+		max = 1
+	}
+	return &blockCache{max: max, items: make(map[int64]*list.Element), order: list.New()}
+}
+
+func (c *blockCache) get(key int64) ([]byte, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *blockCache) put(key int64, data []byte) {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*cacheEntry).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, data: data})
+	if c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+//an io.ReaderAt that keeps the most recently read blocks in memory
+type cachedReaderAt struct {
+	lock      sync.Mutex
+	r         io.ReaderAt
+	blockSize int64
+	cache     *blockCache
+}
+
+//NewCachedReaderAt wraps r so that the last 'blocks' blocks of blockSize bytes
+//that were read are kept in memory. Use it for slow sources, like
+//NewFromReaderAt(NewCachedReaderAt(r, 64*1024, 16), size)
+func NewCachedReaderAt(r io.ReaderAt, blockSize int, blocks int) io.ReaderAt {
+	if blockSize < 1 {
+		blockSize = maxBufLen
+	}
+	return &cachedReaderAt{r: r, blockSize: int64(blockSize), cache: mkBlockCache(blocks)}
+}
+
+func (c *cachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		blk := pos / c.blockSize
+		b, err := c.block(blk)
+		inblk := pos - blk*c.blockSize
+		if inblk < int64(len(b)) {
+			n += copy(p[n:], b[inblk:])
+		}
+		if err != nil && n < len(p) {
+			return n, err
+		}
+		if int64(len(b)) < c.blockSize && n < len(p) {
+			//short block, this is the end
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+//get block blk from the cache, or read it
+func (c *cachedReaderAt) block(blk int64) ([]byte, error) {
+	if b, ok := c.cache.get(blk); ok {
+		return b, nil
+	}
+	b := make([]byte, c.blockSize)
+	n, err := c.r.ReadAt(b, blk*c.blockSize)
+	if err == io.EOF || (err == nil && n == len(b)) {
+		//a short block at the end is fine to keep
+		c.cache.put(blk, b[:n])
+		return b[:n], nil
+	}
+	return b[:n], err
+}
@@ -0,0 +1,227 @@
+package filebuf
+
+/* Checksums
+   Hash streams a range of the buffer through any hash.Hash.
+   CRC32 is smarter: crc's can be combined (crc(a+b) from crc(a), crc(b) and
+   len(b)), so it works piece by piece. Fill pieces are computed without
+   reading them, and with SetChecksumCache the crc's of the blocks of the
+   files behind the pieces are remembered. Checksumming again after an edit
+   then only reads the blocks around the edit.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+//blocks of files whose crc's are cached
+const crcBlockSize = 64 * 1024
+
+//Hash writes the bytes in [start, end) to h and returns h.Sum(nil)
+func (fb *Buffer) Hash(h hash.Hash, start, end int64) ([]byte, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.hash(nil, h, start, end)
+}
+
+func (fb *Buffer) hash(t *task, h hash.Hash, start, end int64) ([]byte, error) {
+	if err := fb.checkRange(start, end); err != nil {
+		return nil, err
+	}
+	err := fb.iterRange(t, start, end, func(b []byte) bool {
+		h.Write(b)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+//CRC32 returns the IEEE crc32 of the bytes in [start, end)
+//This is the same as Hash(crc32.NewIEEE(), start, end), only faster.
+func (fb *Buffer) CRC32(start, end int64) (uint32, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if err := fb.checkRange(start, end); err != nil {
+		return 0, err
+	}
+	var crc uint32
+	var err error
+	fb.pieces(start, end, func(d data, off, size int64) bool {
+		var c uint32
+		c, err = fb.crcs.crc(d, off, size)
+		crc = CRC32Combine(crc, c, size)
+		return err != nil
+	})
+	return crc, err
+}
+
+//SetChecksumCache makes CRC32 remember the crc's of up to 'blocks' blocks
+//of 64K of every file the pieces of fb refer to. 0 turns the cache off.
+func (fb *Buffer) SetChecksumCache(blocks int) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if blocks <= 0 {
+		fb.crcs = nil
+	} else {
+		fb.crcs = &crcCache{max: blocks, files: make(map[io.ReaderAt]*blockCache)}
+	}
+}
+
+func (fb *Buffer) checkRange(start, end int64) error {
+	if start < 0 || start > end || end > fb.size() {
+		return fmt.Errorf("filebuf: bad range [%d, %d) for a buffer of %d bytes", start, end, fb.size())
+	}
+	return nil
+}
+
+//crc's of file blocks, by file
+type crcCache struct {
+	max   int
+	files map[io.ReaderAt]*blockCache
+}
+
+//crc32 of size bytes of d at off
+//the cache can be nil, then file pieces are read entirely
+func (c *crcCache) crc(d data, off, size int64) (uint32, error) {
+	switch d := d.(type) {
+	case *bufData:
+		return crc32.ChecksumIEEE(d.data[off : off+size]), nil
+	case *fillData:
+		return fillCRC(d, off, size), nil
+	case *fileData:
+		if c != nil {
+			return c.fileCRC(d.file, d.offset+off, size)
+		}
+	}
+	return crcAt(d, off, size)
+}
+
+//crc32 of size bytes of file at off, whole blocks come from the cache
+func (c *crcCache) fileCRC(file io.ReaderAt, off, size int64) (uint32, error) {
+	blocks := c.files[file]
+	if blocks == nil {
+		blocks = mkBlockCache(c.max)
+		c.files[file] = blocks
+	}
+	var crc uint32
+	for end := off + size; off < end; {
+		blk := off / crcBlockSize
+		bstart, bend := blk*crcBlockSize, (blk+1)*crcBlockSize
+		if bend > end {
+			bend = end
+		}
+		whole := off == bstart && bend == bstart+crcBlockSize
+		var bcrc uint32
+		if b, ok := blocks.get(blk); ok && whole {
+			bcrc = binary.LittleEndian.Uint32(b)
+		} else {
+			var err error
+			if bcrc, err = crcAt(file, off, bend-off); err != nil {
+				return 0, err
+			}
+			if whole {
+				blocks.put(blk, appendUint32(nil, bcrc))
+			}
+		}
+		crc = CRC32Combine(crc, bcrc, bend-off)
+		off = bend
+	}
+	return crc, nil
+}
+
+//forget about the blocks of file, it changed or is gone
+func (c *crcCache) forget(file io.ReaderAt) {
+	if c != nil {
+		delete(c.files, file)
+	}
+}
+
+//read size bytes of r at off and return their crc32
+func crcAt(r io.ReaderAt, off, size int64) (uint32, error) {
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, io.NewSectionReader(r, off, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return h.Sum32(), err
+}
+
+//crc32 of size bytes of f at off, without writing them all out
+func fillCRC(f *fillData, off, size int64) uint32 {
+	plen := int64(len(f.pattern))
+	pos := (f.phase + off) % plen
+	p := append(append([]byte{}, f.pattern[pos:]...), f.pattern[:pos]...)
+
+	//the crc of n patterns, by doubling
+	var crc uint32
+	pcrc, l := crc32.ChecksumIEEE(p), plen
+	for n := size / plen; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			crc = CRC32Combine(crc, pcrc, l)
+		}
+		pcrc = CRC32Combine(pcrc, pcrc, l)
+		l *= 2
+	}
+	rest := p[:size%plen]
+	return CRC32Combine(crc, crc32.ChecksumIEEE(rest), int64(len(rest)))
+}
+
+//CRC32Combine returns the IEEE crc32 of a+b, given crc1 of a, crc2 of b and the length of b
+//(this is crc32_combine from zlib)
+func CRC32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1 ^ crc2
+	}
+	var even, odd [32]uint32
+	//the operator for one zero bit in odd
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd) //two zero bits
+	gf2MatrixSquare(&odd, &even) //four zero bits
+
+	//apply len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,184 @@
+package filebuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//SaveOption configures how SaveAs writes a buffer
+type SaveOption func(*saveConfig)
+
+type saveConfig struct {
+	format    Compression
+	formatSet bool  //WithCompression was given
+	level     int   //0 is the default for the format
+	frameSize int   //uncompressed size of frames in seekable formats
+	task      *task //nil unless saving with a context
+}
+
+const (
+	bgzipMaxBlock        = 0xff00 //a compressed block always fits in 64K
+	defaultZstdFrameSize = 1 << 20
+)
+
+//the bgzip end-of-file marker, an empty block
+var bgzipEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+//WithCompression makes SaveAs write the buffer compressed in format
+//level is the compression level of the format (gzip: 1-9, zstd: 1-22), 0 is the default.
+func WithCompression(format Compression, level int) SaveOption {
+	return func(c *saveConfig) {
+		c.format = format
+		c.formatSet = true
+		c.level = level
+	}
+}
+
+//WithFrameSize sets the amount of uncompressed data per frame for SeekableZstd
+//Smaller frames make reading faster and compression worse. Frames are at
+//most 64M, bigger ones can't be opened again. Bgzip blocks are always (at most) 64K.
+func WithFrameSize(n int) SaveOption {
+	return func(c *saveConfig) {
+		c.frameSize = n
+	}
+}
+
+//wrap w in a writer that compresses according to cfg
+//Close the result to flush everything, this doesn't close w.
+func compressWriter(w io.Writer, cfg *saveConfig) (io.WriteCloser, error) {
+	switch cfg.format {
+	case Gzip:
+		level := cfg.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		return zstd.NewWriter(w, zstdLevel(cfg.level))
+	case SeekableZstd:
+		enc, err := zstd.NewWriter(nil, zstdLevel(cfg.level))
+		if err != nil {
+			return nil, err
+		}
+		size := cfg.frameSize
+		if size <= 0 {
+			size = defaultZstdFrameSize
+		}
+		if size > zstdMaxFrameSize {
+			size = zstdMaxFrameSize
+		}
+		return &framedWriter{w: w, format: SeekableZstd, size: size, zstd: enc, level: cfg.level}, nil
+	case Bgzip:
+		return &framedWriter{w: w, format: Bgzip, size: bgzipMaxBlock, level: cfg.level}, nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func zstdLevel(level int) zstd.EOption {
+	if level == 0 {
+		return zstd.WithEncoderLevel(zstd.SpeedDefault)
+	}
+	return zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+//cuts the data in frames that are compressed on their own (bgzip, seekable zstd)
+type framedWriter struct {
+	w      io.Writer
+	format Compression
+	size   int //uncompressed frame size
+	level  int
+	buf    []byte
+	zstd   *zstd.Encoder
+	table  []byte //seek table entries
+	frames int
+}
+
+func (f *framedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := f.size - len(f.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		f.buf = append(f.buf, p[:m]...)
+		p = p[m:]
+		if len(f.buf) == f.size {
+			if err := f.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+//compress and write the buffered frame
+func (f *framedWriter) flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	var c []byte
+	switch f.format {
+	case SeekableZstd:
+		c = f.zstd.EncodeAll(f.buf, nil)
+		f.table = appendUint32(appendUint32(f.table, uint32(len(c))), uint32(len(f.buf)))
+	case Bgzip:
+		level := f.level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var blk bytes.Buffer
+		z, err := gzip.NewWriterLevel(&blk, level)
+		if err != nil {
+			return err
+		}
+		z.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		z.Write(f.buf)
+		if err := z.Close(); err != nil {
+			return err
+		}
+		c = blk.Bytes()
+		//BSIZE: the total block size - 1
+		binary.LittleEndian.PutUint16(c[16:], uint16(len(c)-1))
+	}
+	f.frames++
+	f.buf = f.buf[:0]
+	_, err := f.w.Write(c)
+	return err
+}
+
+//write the last frame and the seek table or end-of-file marker
+func (f *framedWriter) Close() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	var err error
+	switch f.format {
+	case SeekableZstd:
+		t := appendUint32(nil, zstdSkippableMagic)
+		t = appendUint32(t, uint32(len(f.table)+zstdSeekFooterSize))
+		t = append(t, f.table...)
+		t = appendUint32(t, uint32(f.frames))
+		t = append(t, 0) //seek table descriptor, no checksums
+		t = appendUint32(t, zstdSeekableMagic)
+		_, err = f.w.Write(t)
+		f.zstd.Close()
+	case Bgzip:
+		_, err = f.w.Write(bgzipEOF)
+	}
+	return err
+}
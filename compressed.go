@@ -0,0 +1,326 @@
+package filebuf
+
+/* Compressed files
+   Some compressed formats are made of independently compressed frames and
+   come with a table (or a header per frame) telling where each frame starts.
+   For those we can build an io.ReaderAt over the decompressed contents that
+   only decompresses the frames it needs, and use it as a fileData source.
+
+   Supported are
+   - bgzip: gzip members of at most 64K, with the compressed size in a header field.
+   - seekable zstd: zstd frames followed by a seek table in a skippable frame.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//Compression is a compressed file format
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	Bgzip                     //blocked gzip, as used by samtools/htslib
+	SeekableZstd              //zstd frames with a seek table
+	Gzip                      //plain gzip, can only be written
+	Zstd                      //plain zstd, can only be written
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "uncompressed"
+	case Bgzip:
+		return "bgzip"
+	case SeekableZstd:
+		return "seekable zstd"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return "unknown compression"
+}
+
+//can we open files in this format?
+func (c Compression) seekable() bool {
+	return c == NoCompression || c == Bgzip || c == SeekableZstd
+}
+
+//OpenCompressed returns an error wrapping this if the file isn't in a seekable format
+//Plain gzip or zstd files can be read with NewFromReader(gzip.NewReader(f)).
+var ErrNotSeekable = errors.New("filebuf: not a seekable compressed file (bgzip or seekable zstd)")
+
+//how many decompressed frames are kept in memory
+const frameCacheSize = 16
+
+//frames that say they are bigger than this are refused, so a damaged or
+//crafted file can't make us allocate gigabytes for one frame
+const (
+	bgzipMaxSize     = 1 << 16 //a bgzip block holds at most 64K
+	zstdMaxFrameSize = 1 << 26 //decompressed, compressed can be a bit more
+)
+
+const (
+	zstdSkippableMagic = 0x184D2A5E
+	zstdSeekableMagic  = 0x8F92EAB1
+	zstdSeekFooterSize = 9
+)
+
+//OpenCompressed opens a compressed file as source for a filebuffer
+//The buffer holds the decompressed contents, frames are only decompressed
+//when they are read. The format is detected from the contents of the file.
+func OpenCompressed(f string, opts ...OpenOption) (*Buffer, error) {
+	var cfg openConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	r, err := openSeekable(f)
+	if err != nil {
+		return nil, err
+	}
+	b, err := mkBacking(f, r, cfg.hash)
+	if err == nil {
+		err = b.lockAs(cfg.lock)
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	b.format, b.length = r.format, r.size
+	return &Buffer{root: mkNode(&fileData{file: r, size: r.size}), backing: []*backing{b}}, nil
+}
+
+//a frame of compressed data
+type frame struct {
+	coff, csize int64 //where it is in the compressed file
+	doff, dsize int64 //where it is in the decompressed contents
+}
+
+//an io.ReaderAt over the decompressed contents of a seekable compressed file
+type seekableReader struct {
+	lock   sync.Mutex
+	file   *os.File
+	format Compression
+	frames []frame
+	size   int64 //decompressed
+	cache  *blockCache
+	zstd   *zstd.Decoder
+}
+
+func openSeekable(name string) (*seekableReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &seekableReader{file: f, cache: mkBlockCache(frameCacheSize)}
+	switch {
+	case isBgzip(f):
+		r.format = Bgzip
+		err = r.indexBgzip(info.Size())
+	case isSeekableZstd(f, info.Size()):
+		r.format = SeekableZstd
+		if err = r.indexZstd(info.Size()); err == nil {
+			r.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		}
+	default:
+		err = fmt.Errorf("%w: %s", ErrNotSeekable, name)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *seekableReader) Close() error {
+	if r.zstd != nil {
+		r.zstd.Close()
+	}
+	return r.file.Close()
+}
+
+func (r *seekableReader) ReadAt(p []byte, off int64) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	//first frame that ends after off
+	i := sort.Search(len(r.frames), func(i int) bool {
+		return r.frames[i].doff+r.frames[i].dsize > off
+	})
+	var n int
+	for ; n < len(p) && i < len(r.frames); i++ {
+		b, err := r.frame(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b[off+int64(n)-r.frames[i].doff:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//decompressed contents of frame i
+func (r *seekableReader) frame(i int) ([]byte, error) {
+	if b, ok := r.cache.get(int64(i)); ok {
+		return b, nil
+	}
+	fr := r.frames[i]
+	var b []byte
+	var err error
+	switch r.format {
+	case Bgzip:
+		var z *gzip.Reader
+		if z, err = gzip.NewReader(io.NewSectionReader(r.file, fr.coff, fr.csize)); err == nil {
+			z.Multistream(false)
+			b = make([]byte, fr.dsize)
+			_, err = io.ReadFull(z, b)
+		}
+	case SeekableZstd:
+		c := make([]byte, fr.csize)
+		if _, err = r.file.ReadAt(c, fr.coff); err == nil {
+			b, err = r.zstd.DecodeAll(c, make([]byte, 0, fr.dsize))
+		}
+	}
+	if err == nil && int64(len(b)) != fr.dsize {
+		err = errors.New("frame has the wrong size")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filebuf: %s: frame %d: %v", r.file.Name(), i, err)
+	}
+	r.cache.put(int64(i), b)
+	return b, nil
+}
+
+//add a frame to the index
+func (r *seekableReader) addFrame(coff, csize, dsize int64) {
+	if dsize > 0 {
+		r.frames = append(r.frames, frame{coff: coff, csize: csize, doff: r.size, dsize: dsize})
+		r.size += dsize
+	}
+}
+
+//does f start with a gzip header with a BC extra field?
+func isBgzip(f io.ReaderAt) bool {
+	_, err := bgzipBlockSize(f, 0)
+	return err == nil
+}
+
+//the size of the bgzip block at off, from its header
+func bgzipBlockSize(f io.ReaderAt, off int64) (int64, error) {
+	hdr := make([]byte, 12)
+	if _, err := f.ReadAt(hdr, off); err != nil {
+		return 0, err
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 || hdr[3]&4 == 0 {
+		return 0, errors.New("not a bgzip block")
+	}
+	extra := make([]byte, binary.LittleEndian.Uint16(hdr[10:]))
+	if _, err := f.ReadAt(extra, off+12); err != nil {
+		return 0, err
+	}
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 && len(extra) >= 6 {
+			return int64(binary.LittleEndian.Uint16(extra[4:])) + 1, nil
+		}
+		if len(extra) < 4+slen {
+			break
+		}
+		extra = extra[4+slen:]
+	}
+	return 0, errors.New("not a bgzip block")
+}
+
+//walk the block headers, the decompressed size is at the end of each block
+func (r *seekableReader) indexBgzip(size int64) error {
+	var isize [4]byte
+	for off := int64(0); off < size; {
+		bsize, err := bgzipBlockSize(r.file, off)
+		if err != nil {
+			return fmt.Errorf("filebuf: %s: block at %d: %v", r.file.Name(), off, err)
+		}
+		if _, err := r.file.ReadAt(isize[:], off+bsize-4); err != nil {
+			return err
+		}
+		dsize := int64(binary.LittleEndian.Uint32(isize[:]))
+		if dsize > bgzipMaxSize {
+			return fmt.Errorf("filebuf: %s: block at %d holds %d bytes", r.file.Name(), off, dsize)
+		}
+		r.addFrame(off, bsize, dsize)
+		off += bsize
+	}
+	return nil
+}
+
+//does f end with a seek table?
+func isSeekableZstd(f io.ReaderAt, size int64) bool {
+	var footer [zstdSeekFooterSize]byte
+	if size < zstdSeekFooterSize {
+		return false
+	}
+	if _, err := f.ReadAt(footer[:], size-zstdSeekFooterSize); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(footer[5:]) == zstdSeekableMagic
+}
+
+//read the seek table at the end of the file
+func (r *seekableReader) indexZstd(size int64) error {
+	var footer [zstdSeekFooterSize]byte
+	if _, err := r.file.ReadAt(footer[:], size-zstdSeekFooterSize); err != nil {
+		return err
+	}
+	nframes := int64(binary.LittleEndian.Uint32(footer[:]))
+	esize := int64(8)
+	if footer[4]&0x80 != 0 {
+		esize += 4 //entries have a checksum
+	}
+	tsize := 8 + nframes*esize + zstdSeekFooterSize
+	if tsize > size {
+		return fmt.Errorf("filebuf: %s: seek table doesn't fit in file", r.file.Name())
+	}
+	table := make([]byte, tsize)
+	if _, err := r.file.ReadAt(table, size-tsize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(table) != zstdSkippableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tsize-8 {
+		return fmt.Errorf("filebuf: %s: bad seek table", r.file.Name())
+	}
+	var coff int64
+	for e := bytes.NewReader(table[8 : tsize-zstdSeekFooterSize]); e.Len() > 0; {
+		entry := make([]byte, esize)
+		e.Read(entry)
+		csize := int64(binary.LittleEndian.Uint32(entry))
+		dsize := int64(binary.LittleEndian.Uint32(entry[4:]))
+		if dsize > zstdMaxFrameSize || csize > 2*zstdMaxFrameSize {
+			return fmt.Errorf("filebuf: %s: frame at %d is too big", r.file.Name(), coff)
+		}
+		r.addFrame(coff, csize, dsize)
+		coff += csize
+	}
+	if coff != size-tsize {
+		return fmt.Errorf("filebuf: %s: seek table doesn't match the frames", r.file.Name())
+	}
+	return nil
+}
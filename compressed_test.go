@@ -0,0 +1,168 @@
+package filebuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//some data that spans a bunch of frames
+var compressTestdata = bytes.Repeat(testdata, 5000)
+
+//write data to a temporary file, compressed with opts
+func writeCompressed(t *testing.T, data []byte, opts ...SaveOption) string {
+	name := tempFile(t, nil)
+	b := NewMem(data)
+	if err := b.SaveAs(name, opts...); err != nil {
+		t.Fatalf("writeCompressed: %v", err)
+	}
+	return name
+}
+
+func TestOpenCompressed(t *testing.T) {
+	for name, fname := range map[string]string{
+		"bgzip":         writeCompressed(t, compressTestdata, WithCompression(Bgzip, 1)),
+		"seekable zstd": writeCompressed(t, compressTestdata, WithCompression(SeekableZstd, 0), WithFrameSize(32*1024)),
+	} {
+		b, err := OpenCompressed(fname)
+		if err != nil {
+			t.Fatalf("TestOpenCompressed(%s): %v", name, err)
+		}
+		if b.Size() != int64(len(compressTestdata)) {
+			t.Fatalf("TestOpenCompressed(%s): size %d, should be %d", name, b.Size(), len(compressTestdata))
+		}
+		//read somewhere in the middle, across a frame boundary
+		buf := make([]byte, 1000)
+		b.Seek(65000, io.SeekStart)
+		b.Read(buf)
+		if !bytes.Equal(buf, compressTestdata[65000:66000]) {
+			t.Fatalf("TestOpenCompressed(%s): read in the middle went wrong", name)
+		}
+		b.Insert(100, helloworld)
+		b.Remove(200000, 1234)
+		want := append(append(append([]byte{}, compressTestdata[:100]...), helloworld...), compressTestdata[100:]...)
+		want = append(want[:200000], want[201234:]...)
+		b.Seek(0, io.SeekStart)
+		got, _ := io.ReadAll(b)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("TestOpenCompressed(%s): contents wrong after edits", name)
+		}
+		b.Close()
+	}
+
+	//frames that say they are huge are refused
+	bg := writeCompressed(t, compressTestdata, WithCompression(Bgzip, 1))
+	data, _ := os.ReadFile(bg)
+	bsize, _ := bgzipBlockSize(bytes.NewReader(data), 0)
+	binary.LittleEndian.PutUint32(data[bsize-4:], 0xffffffff)
+	os.WriteFile(bg, data, 0644)
+	zs := writeCompressed(t, compressTestdata, WithCompression(SeekableZstd, 0))
+	data, _ = os.ReadFile(zs)
+	esize := 8
+	if data[len(data)-5]&0x80 != 0 {
+		esize += 4
+	}
+	nframes := int(binary.LittleEndian.Uint32(data[len(data)-zstdSeekFooterSize:]))
+	binary.LittleEndian.PutUint32(data[len(data)-zstdSeekFooterSize-nframes*esize+4:], 0xffffffff)
+	os.WriteFile(zs, data, 0644)
+	for _, fname := range []string{bg, zs} {
+		if b, err := OpenCompressed(fname); err == nil {
+			b.Close()
+			t.Fatalf("TestOpenCompressed: opened a file with a frame of 4G")
+		}
+	}
+
+	//locks work like they do for plain files
+	fname := writeCompressed(t, compressTestdata, WithCompression(Bgzip, 1))
+	b, err := OpenCompressed(fname, WithLock(LockExclusive))
+	if err != nil {
+		t.Skipf("TestOpenCompressed: can't lock files here: %v", err)
+	}
+	if _, err := OpenCompressed(fname, WithLock(LockShared)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TestOpenCompressed: shared lock while an exclusive lock is held: %v", err)
+	}
+	b.Close()
+	if b, err = OpenCompressed(fname, WithLock(LockShared)); err != nil {
+		t.Fatalf("TestOpenCompressed: shared lock after Close: %v", err)
+	}
+	b.Close()
+
+	plain := tempFile(t, testdata)
+	if _, err := OpenCompressed(plain); !errors.Is(err, ErrNotSeekable) {
+		t.Fatalf("TestOpenCompressed: opening a plain file: %v", err)
+	}
+	os.Remove(plain)
+}
+
+func TestSaveCompressed(t *testing.T) {
+	//plain formats, read them back with the standard readers
+	for _, format := range []Compression{Gzip, Zstd} {
+		fname := writeCompressed(t, compressTestdata, WithCompression(format, 3))
+		f, _ := os.Open(fname)
+		var r io.Reader
+		if format == Gzip {
+			r, _ = gzip.NewReader(f)
+		} else {
+			d, _ := zstd.NewReader(f)
+			defer d.Close()
+			r = d
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, compressTestdata) {
+			t.Fatalf("TestSaveCompressed(%v): contents wrong (%v)", format, err)
+		}
+		f.Close()
+		os.Remove(fname)
+	}
+
+	//seekable formats are saved back in their own format after edits
+	for _, format := range []Compression{Bgzip, SeekableZstd} {
+		fname := writeCompressed(t, compressTestdata, WithCompression(format, 0))
+		b, err := OpenCompressed(fname)
+		if err != nil {
+			t.Fatalf("TestSaveCompressed(%v): %v", format, err)
+		}
+		b.Insert(70000, helloworld)
+		b.Remove(10, 100)
+		want := append(append(append([]byte{}, compressTestdata[:70000]...), helloworld...), compressTestdata[70000:]...)
+		want = append(want[:10], want[110:]...)
+		if err := b.Save(); err != nil {
+			t.Fatalf("TestSaveCompressed(%v): Save: %v", format, err)
+		}
+		if err := b.SaveAs(fname, WithCompression(Gzip, 0)); err == nil {
+			t.Fatalf("TestSaveCompressed(%v): saved over its own file as gzip", format)
+		}
+		b.Close()
+
+		b, err = OpenCompressed(fname)
+		if err != nil {
+			t.Fatalf("TestSaveCompressed(%v): reopen: %v", format, err)
+		}
+		got, _ := io.ReadAll(b)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("TestSaveCompressed(%v): contents wrong after save", format)
+		}
+		//SaveAs over its own file keeps the format too
+		b.Insert(0, helloworld)
+		if err := b.SaveAs(fname); err != nil {
+			t.Fatalf("TestSaveCompressed(%v): SaveAs: %v", format, err)
+		}
+		b.Close()
+		b, err = OpenCompressed(fname)
+		if err != nil {
+			t.Fatalf("TestSaveCompressed(%v): reopen after SaveAs: %v", format, err)
+		}
+		got, _ = io.ReadAll(b)
+		if !bytes.Equal(got, append(append([]byte{}, helloworld...), want...)) {
+			t.Fatalf("TestSaveCompressed(%v): contents wrong after SaveAs", format)
+		}
+		b.Close()
+		os.Remove(fname)
+	}
+}
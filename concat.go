@@ -0,0 +1,90 @@
+package filebuf
+
+/* Concatenated buffers
+   A buffer can be made of several files one after the other, like rotated
+   logs or the parts of a split archive (.001, .002, ...). The tree simply
+   holds fileData pieces of each file, every file is a backing file.
+   SaveSplit does the reverse and writes a buffer out in parts.
+*/
+
+import (
+	"errors"
+	"fmt"
+)
+
+//OpenFiles opens the files at paths as one buffer, in the given order
+//Every file is a backing file of the buffer: they are all locked, checked
+//and reloaded the same way a single file from OpenFile is.
+//Save doesn't work on such a buffer, use SaveAs or SaveSplit.
+//paths can't be empty, use NewEmpty for a buffer without files.
+func OpenFiles(paths []string, opts ...OpenOption) (*Buffer, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("filebuf: OpenFiles: no files")
+	}
+	var cfg openConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	fb := &Buffer{}
+	var pieces []data
+	for _, p := range paths {
+		d, err := mkFileBuf(p)
+		if err != nil {
+			fb.Close()
+			return nil, err
+		}
+		b, err := mkBacking(p, d.file, cfg.hash)
+		if err == nil {
+			err = b.lockAs(cfg.lock)
+		}
+		if err != nil {
+			closeReader(d.file)
+			fb.Close()
+			return nil, err
+		}
+		fb.backing = append(fb.backing, b)
+		pieces = append(pieces, b.contents()...)
+	}
+	fb.setPieces(pieces)
+	return fb, nil
+}
+
+//Concat returns a new buffer with the contents of all buffers, one after the other
+//Like with Copy, the result shares pieces with the buffers it was made from.
+func Concat(buffers ...*Buffer) *Buffer {
+	fb := NewEmpty()
+	for _, b := range buffers {
+		b.lock.Lock()
+		t := &Buffer{root: b.root.Copy()}
+		b.lock.Unlock()
+		fb.destuctivePaste(fb.size(), t)
+	}
+	return fb
+}
+
+//SaveSplit writes fb in parts of partSize bytes to prefix.001, prefix.002, ...
+//The last part can be smaller. It returns the names of the files written,
+//an empty buffer is one empty part.
+//Existing files with those names are replaced.
+func (fb *Buffer) SaveSplit(prefix string, partSize int64) ([]string, error) {
+	if partSize <= 0 {
+		return nil, errors.New("filebuf: SaveSplit: part size must be positive")
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	var names []string
+	for off := int64(0); off == 0 || off < fb.size(); off += partSize {
+		n := partSize
+		if n > fb.size()-off {
+			n = fb.size() - off
+		}
+		name := fmt.Sprintf("%s.%03d", prefix, len(names)+1)
+		part := fb.copy(off, n)
+		if err := part.saveRename(name, 0644, &saveConfig{}); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
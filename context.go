@@ -0,0 +1,179 @@
+package filebuf
+
+/* Long operations
+   Saving, searching or hashing a big file takes a while. The ...Context
+   variants of those operations can be cancelled through a context, and
+   report how far they are through a ProgressFunc. Cancellation is checked
+   between chunks of at most 64K.
+*/
+
+import (
+	"bytes"
+	"context"
+	"hash"
+	"io"
+)
+
+//ProgressFunc is called by the ...Context operations after every chunk of work,
+//with the number of bytes done out of total.
+type ProgressFunc func(done, total int64)
+
+//a long operation: its context and progress
+type task struct {
+	ctx      context.Context
+	progress ProgressFunc
+	done     int64
+	total    int64
+}
+
+func mkTask(ctx context.Context, total int64, progress ProgressFunc) *task {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &task{ctx: ctx, progress: progress, total: total}
+}
+
+//n more bytes are done, returns an error if the task should stop
+//a nil task never stops
+func (t *task) step(n int64) error {
+	if t == nil {
+		return nil
+	}
+	t.done += n
+	if t.progress != nil && n > 0 {
+		t.progress(t.done, t.total)
+	}
+	return t.ctx.Err()
+}
+
+//count the bytes written to w as progress, stop writing when the task is cancelled
+func (t *task) writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &taskWriter{w: w, t: t}
+}
+
+type taskWriter struct {
+	w io.Writer
+	t *task
+}
+
+func (tw *taskWriter) Write(p []byte) (int, error) {
+	if err := tw.t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := tw.w.Write(p)
+	if e := tw.t.step(int64(n)); err == nil {
+		err = e
+	}
+	return n, err
+}
+
+//SaveContext is Save, cancellable through ctx
+//A save in place can only be cancelled before it starts writing,
+//otherwise the file would be left half written.
+func (fb *Buffer) SaveContext(ctx context.Context, progress ProgressFunc) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if len(fb.backing) != 1 {
+		return errSaveNoFile
+	}
+	b := fb.backing[0]
+	return fb.save(b.path, &saveConfig{format: b.format, task: mkTask(ctx, fb.size(), progress)})
+}
+
+//SaveAsContext is SaveAs, cancellable through ctx (see SaveContext)
+func (fb *Buffer) SaveAsContext(ctx context.Context, path string, progress ProgressFunc, opts ...SaveOption) error {
+	var cfg saveConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	cfg.task = mkTask(ctx, fb.size(), progress)
+	return fb.save(path, &cfg)
+}
+
+//WriteTo writes the contents of fb from the current offset to w (io.WriterTo)
+func (fb *Buffer) WriteTo(w io.Writer) (int64, error) {
+	return fb.WriteToContext(context.Background(), w, nil)
+}
+
+//WriteToContext is WriteTo, cancellable through ctx
+func (fb *Buffer) WriteToContext(ctx context.Context, w io.Writer, progress ProgressFunc) (int64, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.offset >= fb.size() {
+		return 0, nil
+	}
+	t := mkTask(ctx, fb.size()-fb.offset, progress)
+	var written int64
+	var werr error
+	err := fb.iterRange(t, fb.offset, fb.size(), func(b []byte) bool {
+		var n int
+		n, werr = w.Write(b)
+		written += int64(n)
+		if werr == nil && n != len(b) {
+			werr = io.ErrShortWrite
+		}
+		return werr != nil
+	})
+	fb.offset += written
+	if werr != nil {
+		return written, werr
+	}
+	return written, err
+}
+
+//Index returns the offset of the first occurrence of pattern at or after from, or -1
+func (fb *Buffer) Index(pattern []byte, from int64) int64 {
+	off, _ := fb.IndexContext(context.Background(), pattern, from, nil)
+	return off
+}
+
+//IndexContext is Index, cancellable through ctx
+func (fb *Buffer) IndexContext(ctx context.Context, pattern []byte, from int64, progress ProgressFunc) (int64, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if from < 0 || from > fb.size() {
+		return -1, nil
+	}
+	return fb.index(mkTask(ctx, fb.size()-from, progress), pattern, from)
+}
+
+func (fb *Buffer) index(t *task, pattern []byte, from int64) (int64, error) {
+	if len(pattern) == 0 {
+		return from, nil
+	}
+	//window holds the end of what we've seen that might be the start of a match
+	var window []byte
+	pos := from //where window starts
+	found := int64(-1)
+	err := fb.iterRange(t, from, fb.size(), func(b []byte) bool {
+		window = append(window, b...)
+		if i := bytes.Index(window, pattern); i >= 0 {
+			found = pos + int64(i)
+			return true
+		}
+		keep := len(pattern) - 1
+		if keep > len(window) {
+			keep = len(window)
+		}
+		drop := len(window) - keep
+		pos += int64(drop)
+		window = append(window[:0], window[drop:]...)
+		return false
+	})
+	if found >= 0 {
+		return found, nil
+	}
+	return -1, err
+}
+
+//HashContext is Hash, cancellable through ctx
+func (fb *Buffer) HashContext(ctx context.Context, h hash.Hash, start, end int64, progress ProgressFunc) ([]byte, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.hash(mkTask(ctx, end-start, progress), h, start, end)
+}
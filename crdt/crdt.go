@@ -0,0 +1,241 @@
+//Package crdt is a replicated sequence (a CRDT) whose content is a filebuf Buffer
+package crdt
+
+/* A replicated growable array (RGA)
+   Every byte ever inserted has an ID: the replica that inserted it and a
+   Lamport clock. An insert goes right after the byte it was typed after (its
+   origin), and concurrent inserts after the same origin are ordered on their
+   IDs, newest first. Deleted bytes stay around as tombstones, so inserts after
+   them still find their place.
+
+   Bytes inserted together have consecutive clocks and are kept as one run,
+   and a run only holds IDs and a size: the bytes themselves are only in the
+   Buffer. The initial content is a run of replica 0, so a document opened
+   from a file stays pieces of that file until it's edited, on every replica.
+
+   Finding a run, by offset or by ID, is logarithmic in the number of runs
+   (see runs.go). Tombstones are never removed: a replica can't know if an
+   insert after one is still on its way, so the runs grow with every edit.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/snhmibby/filebuf"
+)
+
+//ID identifies a byte: the replica that inserted it and the clock at the time
+//Replica 0 is the initial content, its bytes have clocks 1 to the initial size.
+type ID struct {
+	Replica uint64 `json:"replica"`
+	Clock   uint64 `json:"clock"`
+}
+
+//is a older than b? (clocks tie for concurrent edits, then the replica decides)
+func (a ID) less(b ID) bool {
+	return a.Clock < b.Clock || (a.Clock == b.Clock && a.Replica < b.Replica)
+}
+
+//Op is an edit to send to the other replicas
+//An insert puts Insert after the byte Origin (the zero ID is the start), its
+//bytes get IDs ID, ID+1, ... A delete deletes the bytes ID, ID+1, ..., ID+Delete-1.
+type Op struct {
+	ID     ID     `json:"id"`
+	Origin ID     `json:"origin,omitempty"`
+	Insert []byte `json:"insert,omitempty"`
+	Delete uint64 `json:"delete,omitempty"`
+}
+
+//Replica is a copy of the document, materialised in a Buffer
+type Replica struct {
+	lock      sync.Mutex
+	id        uint64
+	clock     uint64 //highest clock seen
+	doc       *filebuf.Buffer
+	root      *run              //of the runs in document order
+	byReplica map[uint64][]*run //the runs of every replica, on clock
+	pending   []Op              //ops that wait for an op they depend on
+}
+
+//New makes replica id (not 0) of a document with initial content doc
+//All replicas start from the same initial content. After this, doc should
+//only be changed through the replica.
+func New(doc *filebuf.Buffer, id uint64) (*Replica, error) {
+	if id == 0 {
+		return nil, errors.New("crdt: replica 0 is the initial content")
+	}
+	r := &Replica{id: id, clock: uint64(doc.Size()), doc: doc, byReplica: make(map[uint64][]*run)}
+	if doc.Size() > 0 {
+		r.insertAfter(nil, &run{id: ID{0, 1}, size: doc.Size()})
+	}
+	return r, nil
+}
+
+//Insert inserts b at offset off of the document
+//It returns the op to send to the other replicas.
+func (r *Replica) Insert(off int64, b []byte) (Op, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off < 0 || off > r.doc.Size() {
+		return Op{}, fmt.Errorf("crdt: insert at %d in a document of %d bytes", off, r.doc.Size())
+	}
+	if len(b) == 0 {
+		return Op{}, errors.New("crdt: empty insert")
+	}
+	op := Op{ID: ID{r.id, r.clock + 1}, Insert: append([]byte{}, b...)}
+	if off > 0 {
+		t, at := r.visible(off - 1)
+		op.Origin = ID{t.id.Replica, t.id.Clock + uint64(at)}
+	}
+	_, err := r.insert(op)
+	return op, err
+}
+
+//Delete deletes size bytes at offset off of the document
+//It returns the ops to send to the other replicas, one for every run of IDs.
+func (r *Replica) Delete(off, size int64) ([]Op, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off < 0 || size < 0 || size > r.doc.Size()-off {
+		return nil, fmt.Errorf("crdt: delete %d bytes at %d in a document of %d bytes", size, off, r.doc.Size())
+	}
+	var ops []Op
+	for size > 0 {
+		t, at := r.visible(off)
+		n := t.size - at
+		if n > size {
+			n = size
+		}
+		op := Op{ID: ID{t.id.Replica, t.id.Clock + uint64(at)}, Delete: uint64(n)}
+		r.delete(op)
+		ops = append(ops, op)
+		size -= n
+	}
+	return ops, nil
+}
+
+//Apply applies an op of another replica
+//Ops can come in any order and more than once: an op that needs an op that
+//didn't come in yet waits for it.
+func (r *Replica) Apply(op Op) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if (len(op.Insert) > 0) == (op.Delete > 0) {
+		return errors.New("crdt: an op inserts or deletes")
+	}
+	r.pending = append(r.pending, op)
+	for progress := true; progress; {
+		progress = false
+		waiting := r.pending[:0]
+		for k, op := range r.pending {
+			var rest *Op
+			if len(op.Insert) > 0 {
+				var err error
+				if rest, err = r.insert(op); err != nil {
+					r.pending = append(waiting, r.pending[k:]...)
+					return err
+				}
+			} else {
+				rest = r.delete(op)
+			}
+			if rest == nil || rest.Delete < op.Delete {
+				progress = true
+			}
+			if rest != nil {
+				waiting = append(waiting, *rest)
+			}
+		}
+		r.pending = waiting
+	}
+	return nil
+}
+
+//Pending returns the number of ops that wait for another op
+func (r *Replica) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
+
+func (r *Replica) tick(id ID, size int64) {
+	if c := id.Clock + uint64(size) - 1; c > r.clock {
+		r.clock = c
+	}
+}
+
+//integrate an insert, it returns op if its origin isn't there yet
+func (r *Replica) insert(op Op) (*Op, error) {
+	if r.find(op.ID) != nil {
+		//seen it
+		return nil, nil
+	}
+	var prev *run //the run it goes after, nil at the start
+	if op.Origin != (ID{}) {
+		o := r.find(op.Origin)
+		if o == nil {
+			return &op, nil
+		}
+		r.split(o, int64(op.Origin.Clock-o.id.Clock)+1)
+		prev = o
+	}
+	//newer inserts after the same origin go first
+	next := r.first()
+	if prev != nil {
+		next = prev.next()
+	}
+	for next != nil && op.ID.less(next.id) {
+		prev, next = next, next.next()
+	}
+
+	var off int64
+	if prev != nil {
+		off = r.offset(prev) + prev.own()
+	}
+	size := int64(len(op.Insert))
+	if err := r.doc.Insert(off, op.Insert); err != nil {
+		return nil, err
+	}
+	r.tick(op.ID, size)
+	if prev != nil {
+		end := ID{prev.id.Replica, prev.id.Clock + uint64(prev.size)}
+		if !prev.deleted && end == op.ID && op.Origin == (ID{end.Replica, end.Clock - 1}) {
+			//typed right after the end of the previous run
+			r.root = splay(prev)
+			prev.size += size
+			prev.resetSize()
+			return nil, nil
+		}
+	}
+	r.insertAfter(prev, &run{id: op.ID, size: size})
+	return nil, nil
+}
+
+//delete the bytes of op, it returns what it couldn't find yet
+func (r *Replica) delete(op Op) *Op {
+	for op.Delete > 0 {
+		t := r.find(op.ID)
+		if t == nil {
+			return &op
+		}
+		if at := int64(op.ID.Clock - t.id.Clock); at > 0 {
+			r.split(t, at)
+			t = r.find(op.ID)
+		}
+		if uint64(t.size) > op.Delete {
+			r.split(t, int64(op.Delete))
+		}
+		n := t.size
+		if !t.deleted {
+			r.doc.Remove(r.offset(t), n)
+			//t is the root now
+			t.deleted = true
+			t.resetSize()
+		}
+		r.tick(op.ID, n)
+		op.ID.Clock += uint64(n)
+		op.Delete -= uint64(n)
+	}
+	return nil
+}
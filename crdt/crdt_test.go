@@ -0,0 +1,142 @@
+package crdt
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/snhmibby/filebuf"
+)
+
+//counts the bytes read from it
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func contents(fb *filebuf.Buffer) string {
+	var b bytes.Buffer
+	fb.Iter(func(p []byte) bool {
+		b.Write(p)
+		return false
+	})
+	return b.String()
+}
+
+func TestConcurrentInserts(t *testing.T) {
+	a, _ := New(filebuf.NewMem([]byte("ac")), 1)
+	b, _ := New(filebuf.NewMem([]byte("ac")), 2)
+	x, _ := a.Insert(1, []byte("b"))
+	y, _ := b.Insert(1, []byte("B"))
+	z, _ := b.Insert(2, []byte("!"))
+	dels, _ := a.Delete(0, 1)
+	for _, op := range []Op{y, z} {
+		if err := a.Apply(op); err != nil {
+			t.Fatalf("TestConcurrentInserts: %v", err)
+		}
+	}
+	//out of order and twice
+	for _, op := range append([]Op{dels[0], x}, dels...) {
+		if err := b.Apply(op); err != nil {
+			t.Fatalf("TestConcurrentInserts: %v", err)
+		}
+	}
+	if sa, sb := contents(a.doc), contents(b.doc); sa != sb || sa != "B!bc" {
+		t.Fatalf("TestConcurrentInserts: %q and %q", sa, sb)
+	}
+	if _, err := New(filebuf.NewEmpty(), 0); err == nil {
+		t.Fatal("TestConcurrentInserts: replica 0")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 10000)
+	src := &countingReaderAt{r: bytes.NewReader(text)}
+
+	const nreplicas = 4
+	var replicas [nreplicas]*Replica
+	var inbox [nreplicas][]Op
+	for i := range replicas {
+		replicas[i], _ = New(filebuf.NewFromReaderAt(src, int64(len(text))), uint64(i+1))
+	}
+	send := func(from int, ops ...Op) {
+		for i := range inbox {
+			if i != from {
+				inbox[i] = append(inbox[i], ops...)
+			}
+		}
+	}
+	//deliver a random op of the inbox of replica i, sometimes twice
+	deliver := func(i int) {
+		k := rnd.Intn(len(inbox[i]))
+		op := inbox[i][k]
+		if rnd.Intn(10) > 0 {
+			inbox[i] = append(inbox[i][:k], inbox[i][k+1:]...)
+		}
+		if err := replicas[i].Apply(op); err != nil {
+			t.Fatalf("TestReplicas: apply: %v", err)
+		}
+	}
+
+	for step := 0; step < 3000; step++ {
+		i := rnd.Intn(nreplicas)
+		r := replicas[i]
+		size := r.doc.Size()
+		switch rnd.Intn(3) {
+		case 0:
+			off := rnd.Int63n(size + 1)
+			op, err := r.Insert(off, []byte("abcdefg"[:rnd.Intn(7)+1]))
+			if err != nil {
+				t.Fatalf("TestReplicas: insert: %v", err)
+			}
+			send(i, op)
+		case 1:
+			off := rnd.Int63n(size)
+			ops, err := r.Delete(off, rnd.Int63n(minInt64(size-off, 100)+1))
+			if err != nil {
+				t.Fatalf("TestReplicas: delete: %v", err)
+			}
+			send(i, ops...)
+		case 2:
+			if len(inbox[i]) > 0 {
+				deliver(i)
+			}
+		}
+	}
+	for i := range replicas {
+		for len(inbox[i]) > 0 {
+			deliver(i)
+		}
+	}
+
+	if src.n != 0 {
+		t.Errorf("TestReplicas: read %d bytes of the initial content", src.n)
+	}
+	want := contents(replicas[0].doc)
+	for i, r := range replicas {
+		if r.Pending() != 0 {
+			t.Fatalf("TestReplicas: replica %d has %d pending ops", i, r.Pending())
+		}
+		if got := contents(r.doc); got != want {
+			t.Fatalf("TestReplicas: replica %d differs", i)
+		}
+		if visible(r.root) != r.doc.Size() {
+			t.Fatalf("TestReplicas: replica %d counts %d visible bytes in %d", i, visible(r.root), r.doc.Size())
+		}
+	}
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package crdt
+
+/* The runs of a replica
+   Runs are kept in document order in a splay tree, like the pieces of a
+   Buffer. Every node knows how many visible (not deleted) bytes its subtree
+   holds, so finding the run at an offset and the offset of a run are both
+   a walk down or up the tree. Next to that, the runs of every replica are
+   kept sorted on clock, to find the run that holds an ID with a binary search.
+*/
+
+import "sort"
+
+//a run of bytes with consecutive IDs
+type run struct {
+	id      ID //of the first byte
+	size    int64
+	deleted bool
+
+	left, right, parent *run
+	visible             int64 //left.visible + the bytes of this run that aren't deleted + right.visible
+}
+
+//does r hold the byte id?
+func (r *run) holds(id ID) bool {
+	return r.id.Replica == id.Replica && r.id.Clock <= id.Clock && id.Clock < r.id.Clock+uint64(r.size)
+}
+
+//the visible bytes of this run itself
+func (r *run) own() int64 {
+	if r.deleted {
+		return 0
+	}
+	return r.size
+}
+
+//helper function to query t.visible, return 0 on t == nil
+func visible(t *run) int64 {
+	if t != nil {
+		return t.visible
+	}
+	return 0
+}
+
+func (t *run) resetSize() {
+	t.visible = visible(t.left) + t.own() + visible(t.right)
+}
+
+func (t *run) setLeft(l *run) {
+	t.left = l
+	if l != nil {
+		l.parent = t
+	}
+	t.resetSize()
+}
+
+func (t *run) setRight(r *run) {
+	t.right = r
+	if r != nil {
+		r.parent = t
+	}
+	t.resetSize()
+}
+
+//the run after t in the document, nil if it's the last one
+func (t *run) next() *run {
+	if t.right != nil {
+		t = t.right
+		for t.left != nil {
+			t = t.left
+		}
+		return t
+	}
+	for t.parent != nil && t == t.parent.right {
+		t = t.parent
+	}
+	return t.parent
+}
+
+//move x one level up, above its parent
+func rotate(x *run) {
+	p, g := x.parent, x.parent.parent
+	if x == p.left {
+		p.setLeft(x.right)
+		x.setRight(p)
+	} else {
+		p.setRight(x.left)
+		x.setLeft(p)
+	}
+	x.parent = g
+	if g == nil {
+	} else if g.left == p {
+		g.setLeft(x)
+	} else {
+		g.setRight(x)
+	}
+}
+
+//see https://en.wikipedia.org/wiki/Splay_tree
+func splay(x *run) *run {
+	for x.parent != nil {
+		p := x.parent
+		if g := p.parent; g != nil {
+			if (g.left == p) == (p.left == x) {
+				rotate(p)
+			} else {
+				rotate(x)
+			}
+		}
+		rotate(x)
+	}
+	return x
+}
+
+//the run that holds visible byte off, and where in the run it is
+func (r *Replica) visible(off int64) (*run, int64) {
+	t := r.root
+	for t != nil {
+		if off < visible(t.left) {
+			t = t.left
+			continue
+		}
+		off -= visible(t.left)
+		if off < t.own() {
+			r.root = splay(t)
+			return t, off
+		}
+		off -= t.own()
+		t = t.right
+	}
+	panic("crdt: offset out of range")
+}
+
+//the offset in the document where t starts
+func (r *Replica) offset(t *run) int64 {
+	r.root = splay(t)
+	return visible(t.left)
+}
+
+//the first run of the document, nil if there are none
+func (r *Replica) first() *run {
+	t := r.root
+	for t != nil && t.left != nil {
+		t = t.left
+	}
+	return t
+}
+
+//the run that holds id, nil if there is none
+func (r *Replica) find(id ID) *run {
+	runs := r.byReplica[id.Replica]
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].id.Clock > id.Clock }) - 1
+	if i >= 0 && runs[i].holds(id) {
+		return runs[i]
+	}
+	return nil
+}
+
+//put t in the document right after prev (at the start if prev is nil)
+func (r *Replica) insertAfter(prev, t *run) {
+	switch {
+	case r.root == nil:
+		t.resetSize()
+		r.root = t
+	case prev == nil:
+		f := splay(r.first())
+		t.resetSize()
+		f.setLeft(t)
+		r.root = f
+	default:
+		r.root = splay(prev)
+		t.setRight(prev.right)
+		prev.setRight(t)
+	}
+	runs := r.byReplica[t.id.Replica]
+	i := sort.Search(len(runs), func(i int) bool { return runs[i].id.Clock > t.id.Clock })
+	runs = append(runs, nil)
+	copy(runs[i+1:], runs[i:])
+	runs[i] = t
+	r.byReplica[t.id.Replica] = runs
+}
+
+//split t so that a run starts at byte at of it
+func (r *Replica) split(t *run, at int64) {
+	if at <= 0 || at >= t.size {
+		return
+	}
+	right := &run{id: ID{t.id.Replica, t.id.Clock + uint64(at)}, size: t.size - at, deleted: t.deleted}
+	r.root = splay(t)
+	t.size = at
+	r.insertAfter(t, right)
+}
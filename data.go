@@ -1,6 +1,7 @@
 package filebuf
 
 import (
+	"bytes"
 	"io"
 	"os"
 
@@ -9,7 +10,8 @@ import (
 
 /***************************************************************************************
  * Data is an interface for a piece of data that comes from a certain source
- * For now we have 2 sources, a memory buffer ([]byte) or a file (io.ReaderAt)
+ * For now we have 3 sources, a memory buffer ([]byte), a file (io.ReaderAt)
+ * or a repeating pattern (zeroes, mostly)
  * TODO: data.Combine(another *Data) *Data {...} kind of functionality
  */
 type data interface {
@@ -157,6 +159,14 @@ func mkFileBuf(fname string) (*fileData, error) {
 	return &f, nil
 }
 
+//close r, if it can be closed
+func closeReader(r io.ReaderAt) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (f *fileData) ReadAt(p []byte, off int64) (int, error) {
 	b := p
 	//bounds checking
@@ -206,9 +216,7 @@ func (f *fileData) Copy() data {
 }
 
 func (f *fileData) WriteTo(out io.Writer) (int64, error) {
-	b := make([]byte, f.size)
-	n, e := f.file.ReadAt(b, f.offset)
-	return int64(n), e
+	return io.Copy(out, io.NewSectionReader(f.file, f.offset, f.size))
 }
 
 func (f *fileData) Combine(d data) data {
@@ -221,3 +229,130 @@ func (f *fileData) Combine(d data) data {
 	}
 	return nil
 }
+
+//A pattern repeated over and over, it takes no memory whatever the size
+type fillData struct {
+	pattern []byte
+	phase   int64 //the piece starts at pattern[phase]
+	size    int64
+
+	//a hole in a sparse file: the file and where the piece is in it
+	file   io.ReaderAt
+	offset int64
+}
+
+//size bytes of pattern, over and over
+func mkFill(pattern []byte, size int64) *fillData {
+	p := make([]byte, len(pattern))
+	copy(p, pattern)
+	return &fillData{pattern: p, size: size}
+}
+
+//the file d reads from (a hole reads as if it did) and where, false if none
+func fileSource(d data) (io.ReaderAt, int64, bool) {
+	switch d := d.(type) {
+	case *fileData:
+		return d.file, d.offset, true
+	case *fillData:
+		return d.file, d.offset, d.file != nil
+	}
+	return nil, 0, false
+}
+
+//the pattern, starting where the piece starts
+func (f *fillData) rotated() []byte {
+	return append(append([]byte{}, f.pattern[f.phase:]...), f.pattern[:f.phase]...)
+}
+
+func (f *fillData) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.size-off {
+		p = p[:f.size-off]
+	}
+	pos := (f.phase + off) % int64(len(f.pattern))
+	n := copy(p, f.pattern[pos:])
+	n += copy(p[n:], f.pattern[:pos])
+	//n is a multiple of the pattern length now, keep doubling
+	for n < len(p) {
+		n += copy(p[n:], p[:n])
+	}
+	return n, nil
+}
+
+func (f *fillData) Size() int64 {
+	return f.size
+}
+
+func (f *fillData) Appendable() bool {
+	return false
+}
+
+func (f *fillData) AppendByte(b byte) {
+	panic("fillData.AppendByte")
+}
+
+func (f *fillData) AppendBytes(b []byte) {
+	panic("fillData.AppendBytes")
+}
+
+func (f *fillData) Split(offset int64) (data, data) {
+	if offset > f.size {
+		panic("fillData.Split: offset > f.size")
+	}
+	l := *f
+	l.size = offset
+
+	r := *f
+	r.phase = (f.phase + offset) % int64(len(f.pattern))
+	r.size -= offset
+	r.offset += offset
+	return &l, &r
+}
+
+func (f *fillData) Copy() data {
+	return f
+}
+
+func (f *fillData) WriteTo(out io.Writer) (int64, error) {
+	//a chunk of a whole number of patterns can be written over and over
+	chunk := int64(64*1024) / int64(len(f.pattern)) * int64(len(f.pattern))
+	if chunk == 0 {
+		chunk = int64(len(f.pattern))
+	}
+	if chunk > f.size {
+		chunk = f.size
+	}
+	buf := make([]byte, chunk)
+	f.ReadAt(buf, 0)
+	var written int64
+	for written < f.size {
+		b := buf
+		if int64(len(b)) > f.size-written {
+			b = b[:f.size-written]
+		}
+		n, err := out.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (f *fillData) Combine(d data) data {
+	f2, ok := d.(*fillData)
+	if !ok {
+		return nil
+	}
+	if f.file != f2.file || (f.file != nil && f.offset+f.size != f2.offset) {
+		return nil
+	}
+	if bytes.Equal(f.pattern, f2.pattern) && (f.phase+f.size)%int64(len(f.pattern)) == f2.phase {
+		c := *f
+		c.size += f2.size
+		return &c
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+package filebuf
+
+/* Diff
+   Buffers made from each other (Copy, Paste, the same OpenFile) share their
+   pieces. Two pieces that read the same part of the same source hold the
+   same bytes, so those parts are matched without reading anything.
+   The matches are chained (in order in both buffers, as many bytes as
+   possible) and only the gaps between them are compared byte by byte:
+   - small gaps with Myers' O(ND) algorithm
+   - bigger gaps are first matched in blocks with a rolling hash (like rsync),
+     then the smaller gaps between those blocks go to Myers.
+   Gaps that are too big to compare in memory, or too different for Myers,
+   become a delete and an insert.
+*/
+
+import (
+	"bytes"
+	"sort"
+)
+
+//DiffOp says what a DiffRange is
+type DiffOp int
+
+const (
+	DiffEqual  DiffOp = iota //the range is the same in a and b
+	DiffDelete               //the range of a is not in b
+	DiffInsert               //the range of b is not in a
+)
+
+func (op DiffOp) String() string {
+	switch op {
+	case DiffEqual:
+		return "equal"
+	case DiffDelete:
+		return "delete"
+	case DiffInsert:
+		return "insert"
+	}
+	return "unknown diff op"
+}
+
+//DiffRange is a step in turning a into b
+//A and B are the offsets in a and b where the step starts.
+//Equal ranges move forward in both, deletes in a, inserts in b.
+type DiffRange struct {
+	Op   DiffOp
+	A, B int64
+	Size int64
+}
+
+const (
+	diffMaxBytes  = 32 << 20 //bigger gaps aren't compared
+	myersMaxBytes = 1 << 16  //gaps up to this size (a+b) go to Myers
+	myersMaxD     = 1000     //Myers gives up after this many edits
+	diffMaxCands  = 4000     //matches considered for a chain
+)
+
+//a range that is the same in a and b
+type match struct {
+	a, b, size int64
+}
+
+//Diff returns the steps that turn a into b
+//Both buffers are only locked while their trees are copied.
+func Diff(a, b *Buffer) ([]DiffRange, error) {
+	return diff(a.snapshot(), b.snapshot())
+}
+
+//diff a and b, nobody else may be using them
+func diff(a, b *Buffer) ([]DiffRange, error) {
+	d := &differ{a: a, b: b}
+	anchors := chain(sharedPieces(a, b))
+	var apos, bpos int64
+	for _, m := range append(anchors, match{a: a.size(), b: b.size()}) {
+		if err := d.gap(apos, m.a, bpos, m.b); err != nil {
+			return nil, err
+		}
+		d.add(DiffEqual, m.a, m.b, m.size)
+		apos, bpos = m.a+m.size, m.b+m.size
+	}
+	return d.out, nil
+}
+
+//[a0, a1) of a is replaced by [b0, b1) of b
+type change struct {
+	a0, a1, b0, b1 int64
+}
+
+//the changes in a diff of a and b: what's between the equal steps
+func byteChanges(steps []DiffRange, aSize, bSize int64) []change {
+	var changes []change
+	var apos, bpos int64
+	for _, st := range append(steps, DiffRange{Op: DiffEqual, A: aSize, B: bSize}) {
+		if st.Op != DiffEqual {
+			continue
+		}
+		if st.A > apos || st.B > bpos {
+			changes = append(changes, change{apos, st.A, bpos, st.B})
+		}
+		apos, bpos = st.A+st.Size, st.B+st.Size
+	}
+	return changes
+}
+
+//a copy of the tree of fb, that can be used without locking
+func (fb *Buffer) snapshot() *Buffer {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return &Buffer{root: fb.root.Copy()}
+}
+
+type differ struct {
+	a, b *Buffer
+	out  []DiffRange
+}
+
+//add a step, merge it with the last one if possible
+func (d *differ) add(op DiffOp, a, b, size int64) {
+	if size <= 0 {
+		return
+	}
+	if n := len(d.out); n > 0 {
+		l := &d.out[n-1]
+		contiguous := (op == DiffInsert || l.A+l.Size == a) && (op == DiffDelete || l.B+l.Size == b)
+		if l.Op == op && contiguous {
+			l.Size += size
+			return
+		}
+	}
+	d.out = append(d.out, DiffRange{Op: op, A: a, B: b, Size: size})
+}
+
+//replace [a0, a1) of a by [b0, b1) of b
+func (d *differ) replace(a0, a1, b0, b1 int64) {
+	d.add(DiffDelete, a0, b0, a1-a0)
+	d.add(DiffInsert, a1, b0, b1-b0)
+}
+
+//diff the gap [a0, a1) of a and [b0, b1) of b
+func (d *differ) gap(a0, a1, b0, b1 int64) error {
+	if a1 == a0 || b1 == b0 || a1-a0 > diffMaxBytes || b1-b0 > diffMaxBytes {
+		d.replace(a0, a1, b0, b1)
+		return nil
+	}
+	x, err := d.a.bytes(a0, a1-a0)
+	if err != nil {
+		return err
+	}
+	y, err := d.b.bytes(b0, b1-b0)
+	if err != nil {
+		return err
+	}
+
+	p, s := commonAffixes(x, y)
+	d.add(DiffEqual, a0, b0, p)
+	x, y = x[p:int64(len(x))-s], y[p:int64(len(y))-s]
+	a0, b0 = a0+p, b0+p
+	if len(x)+len(y) <= myersMaxBytes {
+		d.myers(x, y, a0, b0)
+	} else {
+		//match blocks, then Myers between them
+		var apos, bpos int64
+		for _, m := range append(chain(blockMatches(x, y)), match{a: int64(len(x)), b: int64(len(y))}) {
+			d.myers(x[apos:m.a], y[bpos:m.b], a0+apos, b0+bpos)
+			d.add(DiffEqual, a0+m.a, b0+m.b, m.size)
+			apos, bpos = m.a+m.size, m.b+m.size
+		}
+	}
+	d.add(DiffEqual, a0+int64(len(x)), b0+int64(len(y)), s)
+	return nil
+}
+
+//size bytes of fb at off
+func (fb *Buffer) bytes(off, size int64) ([]byte, error) {
+	b := make([]byte, 0, size)
+	err := fb.iterRange(nil, off, off+size, func(p []byte) bool {
+		b = append(b, p...)
+		return false
+	})
+	return b, err
+}
+
+//length of the common prefix and suffix of x and y, they don't overlap
+func commonAffixes(x, y []byte) (int64, int64) {
+	var p, s int
+	for p < len(x) && p < len(y) && x[p] == y[p] {
+		p++
+	}
+	for s < len(x)-p && s < len(y)-p && x[len(x)-1-s] == y[len(y)-1-s] {
+		s++
+	}
+	return int64(p), int64(s)
+}
+
+//add the steps turning x (at a0 in a) into y (at b0 in b)
+//falls back to a replace if that's too expensive
+func (d *differ) myers(x, y []byte, a0, b0 int64) {
+	p, s := commonAffixes(x, y)
+	d.add(DiffEqual, a0, b0, p)
+	x, y = x[p:int64(len(x))-s], y[p:int64(len(y))-s]
+	a0, b0 = a0+p, b0+p
+	defer d.add(DiffEqual, a0+int64(len(x)), b0+int64(len(y)), s)
+
+	if len(x) == 0 || len(y) == 0 || len(x)+len(y) > myersMaxBytes {
+		d.replace(a0, a0+int64(len(x)), b0, b0+int64(len(y)))
+		return
+	}
+	steps, ok := myers(x, y, myersMaxD)
+	if !ok {
+		d.replace(a0, a0+int64(len(x)), b0, b0+int64(len(y)))
+		return
+	}
+	for _, st := range steps {
+		d.add(st.Op, a0+st.A, b0+st.B, st.Size)
+	}
+}
+
+//Myers' O(ND) diff of x and y, gives up after maxD edits
+func myers(x, y []byte, maxD int) ([]DiffRange, bool) {
+	n, m := len(x), len(y)
+	max := n + m
+	if max > maxD {
+		max = maxD
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	//trace[d] holds v[-d..d] after round d
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var i int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				i = v[off+k+1] //down: insert
+			} else {
+				i = v[off+k-1] + 1 //right: delete
+			}
+			j := i - k
+			for i < n && j < m && x[i] == y[j] {
+				i, j = i+1, j+1
+			}
+			v[off+k] = i
+			done = done || (i >= n && j >= m)
+		}
+		trace = append(trace, append([]int{}, v[off-d:off+d+1]...))
+		if done {
+			return myersSteps(trace, n, m), true
+		}
+	}
+	return nil, false
+}
+
+//walk the trace back from (n, m)
+func myersSteps(trace [][]int, n, m int) []DiffRange {
+	var steps []DiffRange
+	i, j := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		k := i - j
+		prev := trace[d-1] //v[-(d-1)..d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		pi := at(pk)
+		pj := pi - pk
+		//the snake after the edit
+		si, sj := pi, pj
+		op := DiffInsert
+		if pk == k+1 {
+			sj++
+		} else {
+			si++
+			op = DiffDelete
+		}
+		steps = append(steps, DiffRange{Op: DiffEqual, A: int64(si), B: int64(sj), Size: int64(i - si)})
+		steps = append(steps, DiffRange{Op: op, A: int64(pi), B: int64(pj), Size: 1})
+		i, j = pi, pj
+	}
+	steps = append(steps, DiffRange{Op: DiffEqual, Size: int64(i)})
+	for l, r := 0, len(steps)-1; l < r; l, r = l+1, r-1 {
+		steps[l], steps[r] = steps[r], steps[l]
+	}
+	return steps
+}
+
+//the biggest set of matches that are in order in both buffers and don't overlap
+func chain(ms []match) []match {
+	if len(ms) > diffMaxCands {
+		sort.Slice(ms, func(i, j int) bool { return ms[i].size > ms[j].size })
+		ms = ms[:diffMaxCands]
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].a < ms[j].a })
+	best := make([]int64, len(ms)) //most bytes in a chain ending with ms[i]
+	prev := make([]int, len(ms))
+	end := -1
+	for i, m := range ms {
+		best[i], prev[i] = m.size, -1
+		for j := 0; j < i; j++ {
+			if ms[j].a+ms[j].size <= m.a && ms[j].b+ms[j].size <= m.b && best[j]+m.size > best[i] {
+				best[i], prev[i] = best[j]+m.size, j
+			}
+		}
+		if end < 0 || best[i] > best[end] {
+			end = i
+		}
+	}
+	var c []match
+	for i := end; i >= 0; i = prev[i] {
+		c = append(c, ms[i])
+	}
+	for l, r := 0, len(c)-1; l < r; l, r = l+1, r-1 {
+		c[l], c[r] = c[r], c[l]
+	}
+	return c
+}
+
+//a piece, where it is in the buffer and what it reads from
+type segment struct {
+	key  interface{} //the source, nil if it can't be shared
+	src  int64       //offset in the source
+	off  int64       //offset in the buffer
+	size int64
+	fill *fillData
+}
+
+//a source that is a byte slice, keyed by the end of its array
+//pieces split from the same slice share the array (see bufData.Split)
+type sliceEnd *byte
+
+func segments(fb *Buffer) []segment {
+	var segs []segment
+	var off int64
+	fb.root.iter(func(n *node) bool {
+		s := segment{off: off, size: n.data.Size()}
+		switch d := n.data.(type) {
+		case *fileData:
+			s.key, s.src = d.file, d.offset
+		case *bufData:
+			if c := cap(d.data); d.frozen && c > 0 {
+				s.key, s.src = sliceEnd(&d.data[:c][c-1]), -int64(c)
+			}
+		case *fillData:
+			s.key, s.fill = string(d.pattern), d
+		}
+		if s.key != nil && s.size > 0 {
+			segs = append(segs, s)
+		}
+		off += s.size
+		return false
+	})
+	return segs
+}
+
+//the ranges of a and b that read the same part of the same source
+func sharedPieces(a, b *Buffer) []match {
+	bsegs := make(map[interface{}][]segment)
+	for _, s := range segments(b) {
+		bsegs[s.key] = append(bsegs[s.key], s)
+	}
+	var ms []match
+	for _, sa := range segments(a) {
+		for _, sb := range bsegs[sa.key] {
+			if sa.fill != nil {
+				if m, ok := fillMatch(sa, sb); ok {
+					ms = append(ms, m)
+				}
+				continue
+			}
+			lo, hi := sa.src, sa.src+sa.size
+			if sb.src > lo {
+				lo = sb.src
+			}
+			if sb.src+sb.size < hi {
+				hi = sb.src + sb.size
+			}
+			if lo < hi {
+				ms = append(ms, match{a: sa.off + lo - sa.src, b: sb.off + lo - sb.src, size: hi - lo})
+			}
+		}
+	}
+	return ms
+}
+
+//line up two fill pieces of the same pattern
+func fillMatch(sa, sb segment) (match, bool) {
+	plen := int64(len(sa.fill.pattern))
+	da := ((sb.fill.phase-sa.fill.phase)%plen + plen) % plen
+	var db int64
+	if da >= sa.size {
+		da, db = 0, ((sa.fill.phase-sb.fill.phase)%plen+plen)%plen
+	}
+	size := sa.size - da
+	if sb.size-db < size {
+		size = sb.size - db
+	}
+	return match{a: sa.off + da, b: sb.off + db, size: size}, size > 0
+}
+
+//match blocks of x in y with a rolling hash
+func blockMatches(x, y []byte) []match {
+	bs := len(x) / 65536
+	if bs < 32 {
+		bs = 32
+	}
+	if len(x) < bs || len(y) < bs {
+		return nil
+	}
+	index := make(map[uint32][]int)
+	for i := 0; i+bs <= len(x); i += bs {
+		h := rollHash(x[i : i+bs])
+		index[h] = append(index[h], i)
+	}
+	//prime^(bs-1), to take the first byte out
+	pow := uint32(1)
+	for i := 1; i < bs; i++ {
+		pow *= rollPrime
+	}
+
+	var ms []match
+	h := rollHash(y[:bs])
+	for j := 0; j+bs <= len(y); {
+		matched := false
+		for _, i := range index[h] {
+			if bytes.Equal(x[i:i+bs], y[j:j+bs]) {
+				l := bs
+				for i+l < len(x) && j+l < len(y) && x[i+l] == y[j+l] {
+					l++
+				}
+				ms = append(ms, match{a: int64(i), b: int64(j), size: int64(l)})
+				j += l
+				matched = true
+				break
+			}
+		}
+		if matched {
+			if j+bs <= len(y) {
+				h = rollHash(y[j : j+bs])
+			}
+			continue
+		}
+		if j+bs < len(y) {
+			h = (h-uint32(y[j])*pow)*rollPrime + uint32(y[j+bs])
+		}
+		j++
+	}
+	return ms
+}
+
+const rollPrime = 16777619
+
+func rollHash(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		h = h*rollPrime + uint32(c)
+	}
+	return h
+}
@@ -0,0 +1,116 @@
+package filebuf
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+//an io.ReaderAt that counts the bytes read from it
+type countingReaderAt struct {
+	r *bytes.Reader
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+//turn a into b with the diff, return the result
+func applyDiff(t *testing.T, a, b []byte, diff []DiffRange) []byte {
+	var out []byte
+	var apos, bpos int64
+	for _, d := range diff {
+		if (d.Op != DiffInsert && d.A != apos) || (d.Op != DiffDelete && d.B != bpos) {
+			t.Fatalf("diff step %v at (%d, %d), should be at (%d, %d)", d, d.A, d.B, apos, bpos)
+		}
+		switch d.Op {
+		case DiffEqual:
+			if !bytes.Equal(a[d.A:d.A+d.Size], b[d.B:d.B+d.Size]) {
+				t.Fatalf("diff step %v isn't equal", d)
+			}
+			out = append(out, a[d.A:d.A+d.Size]...)
+			apos += d.Size
+			bpos += d.Size
+		case DiffDelete:
+			apos += d.Size
+		case DiffInsert:
+			out = append(out, b[d.B:d.B+d.Size]...)
+			bpos += d.Size
+		}
+	}
+	if apos != int64(len(a)) || bpos != int64(len(b)) {
+		t.Fatalf("diff ends at (%d, %d), should be (%d, %d)", apos, bpos, len(a), len(b))
+	}
+	return out
+}
+
+func readAll(b *Buffer) []byte {
+	b.Seek(0, io.SeekStart)
+	c, _ := io.ReadAll(b)
+	return c
+}
+
+func TestDiff(t *testing.T) {
+	//shared pieces aren't read
+	src := bytes.Repeat(testdata, 10000)
+	cr := &countingReaderAt{r: bytes.NewReader(src)}
+	a := NewFromReaderAt(cr, int64(len(src)))
+	b := a.Copy(0, a.Size())
+	b.Insert(100000, helloworld)
+	b.Remove(2000, 3000)
+	b.Paste(b.Size(), a.Copy(5000, 5000))
+	b.InsertFill(700000, []byte{0}, 100000)
+	diff, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("TestDiff: %v", err)
+	}
+	if cr.n != 0 {
+		t.Fatalf("TestDiff: read %d bytes of shared pieces", cr.n)
+	}
+	if got := applyDiff(t, readAll(a), readAll(b), diff); !bytes.Equal(got, readAll(b)) {
+		t.Fatal("TestDiff: shared diff doesn't turn a into b")
+	}
+
+	//unrelated buffers with the same bytes
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 10, 1000, 200000} {
+		x := make([]byte, size)
+		rnd.Read(x)
+		y := append([]byte{}, x...)
+		for i := 0; i < 20 && len(y) > 0; i++ {
+			off := rnd.Intn(len(y))
+			switch rnd.Intn(3) {
+			case 0:
+				y = append(y[:off], append([]byte("some inserted text"), y[off:]...)...)
+			case 1:
+				end := off + rnd.Intn(50)
+				if end > len(y) {
+					end = len(y)
+				}
+				y = append(y[:off], y[end:]...)
+			case 2:
+				y[off]++
+			}
+		}
+		diff, err := Diff(NewMem(x), NewMem(y))
+		if err != nil {
+			t.Fatalf("TestDiff(%d): %v", size, err)
+		}
+		if got := applyDiff(t, x, y, diff); !bytes.Equal(got, y) {
+			t.Fatalf("TestDiff(%d): diff doesn't turn a into b", size)
+		}
+		var changed int64
+		for _, d := range diff {
+			if d.Op != DiffEqual {
+				changed += d.Size
+			}
+		}
+		if changed > 2000 {
+			t.Fatalf("TestDiff(%d): %d bytes changed, diff is too coarse", size, changed)
+		}
+	}
+}
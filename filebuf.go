@@ -3,19 +3,19 @@ package filebuf
 
 /* A FileBuffer maintains a representation of a buffer in a splay tree,
    where each node in the tree represents a portion of the buffer.
-   The data in a node can be either a portion of a file or a byte slice.
+   The data in a node can be a portion of a file, a byte slice or a repeating pattern.
    Cut, Copy and Paste operations thus only copy a tree, not an entire slice.
    Insert becomes (possibly) splitting a node and appending to a slice.
 
-   Saving to a file becomes a bit cumbersome to do efficiently and is not implemented (yet).
-   You can io.Copy the buffer to a temporary file and rename it to the original.
-   This serializes the entire buffer and is not necessary and slow :((
+   Saving to a file becomes a bit cumbersome to do efficiently, see save.go.
+   If the file pieces are still in their original place, only the changed parts are written.
+   Otherwise the buffer is written to a temporary file that is renamed to the original.
 */
 
 /* TODO:
  * - make Write less inefficient, esp in the case of writing 1 byte
  * - be consistent with panics or returning error
- * - smart writing back to original file (.Save()... operation)
+ * - smarter writing back to original file, Save() only works in place if no file pieces moved
  * - allow for combining nodes if possible
  *   having many small nodes eats memory and grows the tree so everyting bogs down.
  *   having bigger nodes make it a lot faster.
@@ -33,6 +33,20 @@ type Buffer struct {
 	lock   sync.Mutex //very coarse thread safety
 	root   *node
 	offset int64 //to implement io.ReaderSeeker
+
+	//memory budget, see spill.go
+	memLimit   int64
+	scratchDir string
+	scratch    *scratchFile
+
+	backing []*backing    //files on disk the buffer was opened from
+	retired []io.ReaderAt //old files of backing, still read from (see retire)
+	journal *journal      //see journal.go
+	script  *EditScript   //see script.go
+	watcher *watcher      //see watch_*.go
+	stream  *stream       //see stream.go
+	crcs    *crcCache     //see checksum.go
+	source  io.ReaderAt   //the original of NewFromReaderAt and NewFromReader
 }
 
 func NewEmpty() *Buffer {
@@ -44,15 +58,88 @@ func NewMem(b []byte) *Buffer {
 	return &Buffer{root: mkNode(mkBuf(b))}
 }
 
+//OpenOption configures how OpenFile opens a file
+type OpenOption func(*openConfig)
+
+type openConfig struct {
+	hash bool
+	lock LockMode
+}
+
+//WithHash makes OpenFile remember a hash of the file contents,
+//so CheckBacking also catches changes that keep size and mtime intact.
+//This reads the entire file on open and on every check.
+func WithHash() OpenOption {
+	return func(c *openConfig) {
+		c.hash = true
+	}
+}
+
 //Open file 'f' as source for a filebuffer
+//Holes in sparse files are found and take no disk reads.
 //As long as you are using buffers predicated on 'f',
-//you probably shouldn't change the file on disk
-func OpenFile(f string) (*Buffer, error) {
+//you probably shouldn't change the file on disk (see CheckBacking)
+func OpenFile(f string, opts ...OpenOption) (*Buffer, error) {
+	var cfg openConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
 	d, err := mkFileBuf(f)
 	if err != nil {
 		return nil, err
 	}
-	return &Buffer{root: mkNode(d)}, nil
+	b, err := mkBacking(f, d.file, cfg.hash)
+	if err == nil {
+		err = b.lockAs(cfg.lock)
+	}
+	if err != nil {
+		closeReader(d.file)
+		return nil, err
+	}
+	fb := &Buffer{backing: []*backing{b}}
+	fb.setPieces(b.contents())
+	return fb, nil
+}
+
+//Use the first size bytes of r as source for a filebuffer
+//r can be anything: a bytes.Reader, io.SectionReader, block device, a member of an archive...
+//Just like with OpenFile, the data in r shouldn't change while buffers use it.
+//Wrap slow sources with NewCachedReaderAt.
+func NewFromReaderAt(r io.ReaderAt, size int64) *Buffer {
+	return &Buffer{root: mkNode(&fileData{file: r, size: size}), source: r}
+}
+
+//Close releases everything fb holds on to: locks and handles of its backing files,
+//the scratch file and the watcher. A journal is stopped and removed and
+//data from a stream isn't appended anymore (see NewFromReader).
+//Buffers that share pieces with fb (made with Copy or Cut) can't be read after this.
+func (fb *Buffer) Close() error {
+	err := fb.StopJournal()
+	fb.Unwatch()
+
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.stream != nil {
+		fb.stream.close()
+	}
+	for _, b := range fb.backing {
+		if e := b.unlock(); err == nil {
+			err = e
+		}
+		if e := closeReader(b.file); err == nil {
+			err = e
+		}
+	}
+	fb.backing = nil
+	for _, r := range fb.retired {
+		closeReader(r)
+	}
+	fb.retired = nil
+	if fb.scratch != nil {
+		fb.scratch.file.Close()
+		fb.scratch = nil
+	}
+	return err
 }
 
 /*
@@ -73,9 +160,13 @@ func (fb *Buffer) Seek(offset int64, whence int) (int64, error) {
 }
 
 //io.Writer
+//Like with os.File, an empty write past the end doesn't grow fb.
 func (fb *Buffer) Write(p []byte) (int, error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
 	return fb.write(p)
 }
 
@@ -134,6 +225,22 @@ func (fb *Buffer) Insert1(offset int64, b byte) error {
 	return fb.insert1(offset, b)
 }
 
+//Insert n bytes of pattern, repeated over and over (the last one might be cut short)
+//This takes no memory, no matter how big n is.
+func (fb *Buffer) InsertFill(offset int64, pattern []byte, n int64) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.insertFill(offset, pattern, n)
+}
+
+//Overwrite n bytes at offset with pattern, repeated over and over
+//The buffer grows if offset+n is past the end.
+func (fb *Buffer) Fill(offset int64, n int64, pattern []byte) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.fill(offset, n, pattern)
+}
+
 //iterate over the file, give the callback byte slices for READING ONLY
 func (fb *Buffer) Iter(cb func([]byte) bool) {
 	fb.IterFrom(0, cb)
@@ -146,6 +253,21 @@ func (fb *Buffer) IterFrom(from int64, cb func([]byte) bool) {
 	fb.iterFrom(from, cb)
 }
 
+//Truncate changes the size of fb to size, like os.File.Truncate
+//Bytes past size are removed, a bigger buffer is filled up with zeroes.
+func (fb *Buffer) Truncate(size int64) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.resize("Truncate", size, 0)
+}
+
+//Resize changes the size of fb to size, a bigger buffer is filled up with fill
+func (fb *Buffer) Resize(size int64, fill byte) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.resize("Resize", size, fill)
+}
+
 /*
  * interface implementation
  */
@@ -159,8 +281,8 @@ func (fb *Buffer) seek(offset int64, whence int) (int64, error) {
 	case whence == io.SeekEnd:
 		newoff = fb.size() + offset
 	}
-	if newoff < 0 || newoff > fb.size() {
-		//actually fb.offset > fb.size() should be legal, but meh
+	//seeking past the end is fine, a write there fills the gap with zeroes
+	if newoff < 0 {
 		return fb.offset, fmt.Errorf("FileBuffer.Seek() bad offset (%d)", newoff)
 	}
 	fb.offset = newoff
@@ -179,7 +301,9 @@ func (fb *Buffer) write(p []byte) (int, error) {
 		fb.remove(fb.offset, plen)
 	} else {
 		if fb.offset > fb.size() {
-			return 0, fmt.Errorf("FileBuffer.Write: Attempt to write past EOF")
+			if err := fb.insertFill(fb.size(), []byte{0}, fb.offset-fb.size()); err != nil {
+				return 0, err
+			}
 		} else if fb.offset < fb.size() {
 			fb.remove(fb.offset, fb.size()-fb.offset)
 		}
@@ -231,6 +355,15 @@ func (fb *Buffer) remove(offset int64, size int64) {
 }
 
 func (fb *Buffer) cut(offset int64, size int64) *Buffer {
+	cut := fb.detach(offset, size)
+	if size > 0 && fb.recording() {
+		fb.record(&edit{op: opDelete, off: offset, size: size})
+	}
+	return cut
+}
+
+//take size bytes at offset out of the tree, without telling anybody
+func (fb *Buffer) detach(offset int64, size int64) *Buffer {
 	if offset < 0 || offset > fb.size() || fb.size() < offset+size {
 		panic("FileBuffer.Cut: bad offset")
 	}
@@ -252,7 +385,7 @@ func (fb *Buffer) copy(offset int64, size int64) *Buffer {
 	if offset < 0 || offset > fb.size() || fb.size() < offset+size {
 		panic("FileBuffer.Copy(): offset or size out of bounds")
 	}
-	tmpCut := fb.cut(offset, size)
+	tmpCut := fb.detach(offset, size)
 	cpy := &Buffer{root: tmpCut.root.Copy()}
 	fb.destuctivePaste(offset, tmpCut)
 	return cpy
@@ -270,7 +403,12 @@ func (fb *Buffer) destuctivePaste(offset int64, paste *Buffer) {
 func (fb *Buffer) paste(offset int64, paste *Buffer) {
 	if paste != nil && paste.Size() > 0 {
 		p := Buffer{root: paste.root.Copy()}
+		if fb.recording() {
+			fb.record(&edit{op: opInsert, off: offset, size: p.size(), tree: &p})
+		}
 		fb.destuctivePaste(offset, &p)
+		//spilling is best effort here, if it fails the data just stays in memory
+		fb.spill()
 	}
 }
 
@@ -326,7 +464,12 @@ func (fb *Buffer) insert(offset int64, bs []byte) error {
 	fb.makeAppendable()
 	fb.root.data.AppendBytes(bs)
 	fb.root.resetSize()
-	return nil
+	if fb.recording() {
+		if err := fb.record(&edit{op: opInsert, off: offset, size: int64(len(bs)), data: bs}); err != nil {
+			return err
+		}
+	}
+	return fb.spill()
 }
 
 func (fb *Buffer) insert1(offset int64, b byte) error {
@@ -340,6 +483,60 @@ func (fb *Buffer) insert1(offset int64, b byte) error {
 	fb.makeAppendable()
 	fb.root.data.AppendByte(b)
 	fb.root.resetSize()
+	if fb.recording() {
+		if err := fb.record(&edit{op: opInsert, off: offset, size: 1, data: []byte{b}}); err != nil {
+			return err
+		}
+	}
+	return fb.spill()
+}
+
+func (fb *Buffer) insertFill(offset int64, pattern []byte, n int64) error {
+	if offset < 0 || offset > fb.size() {
+		return fmt.Errorf("FileBuffer.InsertFill(): bad offset (%d)", offset)
+	} else if n < 0 {
+		return fmt.Errorf("FileBuffer.InsertFill(): negative size (%d)", n)
+	} else if len(pattern) == 0 {
+		return fmt.Errorf("FileBuffer.InsertFill(): empty pattern")
+	}
+	if n == 0 {
+		return nil
+	}
+
+	d := mkFill(pattern, n)
+	fb.destuctivePaste(offset, &Buffer{root: mkNode(d)})
+	if fb.recording() {
+		return fb.record(&edit{op: opFill, off: offset, size: n, data: d.pattern})
+	}
+	return nil
+}
+
+func (fb *Buffer) fill(offset int64, n int64, pattern []byte) error {
+	if offset < 0 || offset > fb.size() {
+		return fmt.Errorf("FileBuffer.Fill(): bad offset (%d)", offset)
+	} else if n < 0 {
+		return fmt.Errorf("FileBuffer.Fill(): negative size (%d)", n)
+	} else if len(pattern) == 0 {
+		return fmt.Errorf("FileBuffer.Fill(): empty pattern")
+	}
+	del := n
+	if del > fb.size()-offset {
+		del = fb.size() - offset
+	}
+	fb.remove(offset, del)
+	return fb.insertFill(offset, pattern, n)
+}
+
+//caller is the method the error is for
+func (fb *Buffer) resize(caller string, size int64, fill byte) error {
+	switch {
+	case size < 0:
+		return fmt.Errorf("FileBuffer.%s(): negative size (%d)", caller, size)
+	case size < fb.size():
+		fb.remove(size, fb.size()-size)
+	case size > fb.size():
+		return fb.insertFill(fb.size(), []byte{fill}, size-fb.size())
+	}
 	return nil
 }
 
@@ -360,39 +557,91 @@ func (fb *Buffer) makeAppendable() {
 	}
 }
 
-func (fb *Buffer) stats(name string) {
-	var st stats
-	st.minsz = fb.size() + 1
-	fb.root.stats(&st, 0)
-	fmt.Printf("\n----- STATS FOR BUFFER %s\nsize = %d\n", name, st.size)
-	fmt.Printf("stats.numnodes=%d (file: %d, data: %d (fixed: %d))\n", st.numnodes, st.filenodes, st.datanodes, st.fixeddata)
-	fmt.Printf("avg node size: %f (min: %d, max: %d)\n", st.avgsz, st.minsz, st.maxsz)
-	fmt.Printf("maxdepth: %d (avg: %f)\n", st.maxdist, st.avgdist)
+func (fb *Buffer) iterFrom(from int64, cb func([]byte) bool) {
+	fb.iterRange(nil, from, fb.size(), cb)
 }
 
-func (fb *Buffer) iterFrom(from int64, cb func([]byte) bool) {
-	fb.root.iter(func(n *node) bool {
-		var stop = false
-		switch n.data.(type) {
-		case *fileData:
-			//if region is big, split into chunks
-			f := n.data.(*fileData)
-			var done int64 = 0
-			buf := make([]byte, maxBufLen)
-			for !stop && done < f.size {
-				if f.size-done < maxBufLen {
-					buf = buf[:f.size-done]
+//the biggest slice iterRange gives out of a memory piece
+const iterChunk = 64 * 1024
+
+//give cb the bytes in [start, end), in chunks
+//t (can be nil) is told about every chunk, and stops the iteration when it is cancelled
+func (fb *Buffer) iterRange(t *task, start, end int64, cb func([]byte) bool) error {
+	var err error
+	var buf []byte
+	fb.pieces(start, end, func(d data, off, size int64) bool {
+		if b, ok := d.(*bufData); ok {
+			//no copying, but still in chunks to check on t
+			for done := int64(0); done < size; {
+				n := size - done
+				if n > iterChunk {
+					n = iterChunk
+				}
+				if cb(b.data[off+done : off+done+n]) {
+					return true
 				}
-				n, err := f.file.ReadAt(buf, f.offset+done)
-				done += int64(n)
-				stop = cb(buf[:n])
-				if err != nil {
-					stop = stop || done != f.size
+				done += n
+				if err = t.step(n); err != nil {
+					return true
 				}
 			}
-		case *bufData:
-			stop = cb(n.data.(*bufData).data)
+			return false
+		}
+		//if region is big, split into chunks
+		if buf == nil {
+			buf = make([]byte, maxBufLen)
+		}
+		for done := int64(0); done < size; {
+			chunk := buf
+			if size-done < int64(len(chunk)) {
+				chunk = chunk[:size-done]
+			}
+			n, e := d.ReadAt(chunk, off+done)
+			done += int64(n)
+			if n > 0 && cb(chunk[:n]) {
+				return true
+			}
+			if err = t.step(int64(n)); err != nil {
+				return true
+			}
+			if e != nil && done < size {
+				err = e
+				return true
+			} else if n == 0 && e == nil {
+				err = io.ErrNoProgress
+				return true
+			}
 		}
-		return stop
+		return false
 	})
+	return err
+}
+
+//call cb with the part [off, off+size) of every piece that overlaps [start, end)
+//stop when cb returns true
+func (fb *Buffer) pieces(start, end int64, cb func(d data, off, size int64) bool) {
+	if start >= end {
+		return
+	}
+	n, inNode := fb.root.get(start)
+	fb.root = splay(n)
+	pos := start - inNode //where the current piece starts
+	visit := func(t *node) bool {
+		sz := t.data.Size()
+		lo, hi := start-pos, end-pos
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > sz {
+			hi = sz
+		}
+		pos += sz
+		if lo < hi && cb(t.data, lo, hi-lo) {
+			return true
+		}
+		return pos >= end
+	}
+	if !visit(fb.root) {
+		fb.root.right.iter(visit)
+	}
 }
@@ -8,9 +8,15 @@ package filebuf
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
 	"io"
 	"math/rand"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -325,8 +331,8 @@ func TestCutCopyPaste(t *testing.T) {
 		c1.Paste(o2, p2)
 		b.Paste(o1, p1)
 	}
-	btest.stats("Normal testdata")
-	b.stats("Chopped up testdata (lot of cuts & pastes)")
+	t.Logf("\n----- STATS FOR BUFFER Normal testdata\n%s", btest.Stats())
+	t.Logf("\n----- STATS FOR BUFFER Chopped up testdata (lot of cuts & pastes)\n%s", b.Stats())
 
 	if !compareBuf2File(b, testfile) {
 		t.Fatal("TestCutCopyPaste: after everything, buffer != testfile")
@@ -407,6 +413,576 @@ func TestIter(t *testing.T) {
 	}
 }
 
+func TestStats(t *testing.T) {
+	b := NewMem(testdata)
+	st := b.Stats()
+	if st.Nodes != 1 || st.MemNodes != 1 || st.MemBytes != int64(len(testdata)) || st.Fragmentation != 0 {
+		t.Fatalf("TestStats: unexpected stats for NewMem:\n%s", st)
+	}
+
+	createTestData(b)
+	st = b.Stats()
+	if st.Size != b.Size() {
+		t.Fatalf("TestStats: size %d != buffer size %d", st.Size, b.Size())
+	}
+	if st.Nodes != st.FileNodes+st.MemNodes {
+		t.Fatalf("TestStats: node kinds don't add up:\n%s", st)
+	}
+	if st.MemBytes+st.FileBytes != st.Size {
+		t.Fatalf("TestStats: bytes don't add up:\n%s", st)
+	}
+	if st.Fragmentation <= 0 || st.Fragmentation > 1 {
+		t.Fatalf("TestStats: weird fragmentation %f", st.Fragmentation)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	const limit = 64 * 1024
+	b := NewEmpty()
+	btest := NewEmpty()
+	if err := b.SetMemoryLimit(limit); err != nil {
+		t.Fatalf("TestMemoryLimit: SetMemoryLimit: %v", err)
+	}
+	createTestData(b)
+	createTestData(btest)
+
+	//the last edited piece is never spilled, allow for that
+	if b.MemoryUsage() > limit+2*maxBufLen {
+		t.Fatalf("TestMemoryLimit: memory usage %d over limit %d", b.MemoryUsage(), limit)
+	}
+	if st := b.Stats(); st.FileNodes == 0 {
+		t.Fatal("TestMemoryLimit: nothing was spilled to the scratch file")
+	}
+
+	f, _ := os.CreateTemp("", "TESTFILE")
+	defer os.Remove(f.Name())
+	btest.Dump(f)
+	if !compareBuf2File(b, f) {
+		t.Fatal("TestMemoryLimit: spilled buffer != in-memory buffer")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	orig, _ := os.CreateTemp("", "TESTFILE")
+	defer os.Remove(orig.Name())
+	orig.Write(testdata)
+	orig.Close()
+	jname := orig.Name() + ".journal"
+	defer os.Remove(jname)
+
+	b, err := OpenFile(orig.Name())
+	if err != nil {
+		t.Fatalf("TestJournal: OpenFile: %v", err)
+	}
+	//edits before the journal is started end up in the snapshot
+	b.Insert(5, helloworld)
+	b.Remove(0, 3)
+	b.InsertFill(2, []byte("abc"), 10)
+	b.Insert(6, []byte("-"))
+	if err := b.StartJournal(jname); err != nil {
+		t.Fatalf("TestJournal: StartJournal: %v", err)
+	}
+	b.Paste(b.Size(), b.Copy(2, 20))
+	b.Insert1(7, 'x')
+	b.Seek(10, io.SeekStart)
+	b.Write(testdata_line2)
+	b.Remove(30, 12)
+	b.Fill(4, 9, []byte{0xde, 0xad})
+
+	r, err := Recover(jname, orig.Name())
+	if err != nil {
+		t.Fatalf("TestJournal: Recover: %v", err)
+	}
+	b.Seek(0, io.SeekStart)
+	want, _ := io.ReadAll(b)
+	if !compareBuf2Bytes(r, want) {
+		t.Fatal("TestJournal: recovered buffer != edited buffer")
+	}
+
+	//a torn record at the end is ignored
+	info, _ := os.Stat(jname)
+	os.Truncate(jname, info.Size()-2)
+	if _, err := Recover(jname, orig.Name()); err != nil {
+		t.Fatalf("TestJournal: Recover with torn record: %v", err)
+	}
+
+	//a damaged record before the end isn't
+	bad := jname + ".bad"
+	defer os.Remove(bad)
+	j, _ := os.ReadFile(jname)
+	j[bytes.Index(j, testdata_line2)] ^= 0xff
+	os.WriteFile(bad, j, 0600)
+	if _, err := Recover(bad, orig.Name()); !errors.Is(err, ErrCorruptJournal) {
+		t.Fatalf("TestJournal: Recover with damaged record: %v", err)
+	}
+
+	//and the original file may not change
+	os.WriteFile(orig.Name(), helloworld, 0600)
+	if _, err := Recover(jname, orig.Name()); !errors.Is(err, ErrOriginalChanged) {
+		t.Fatalf("TestJournal: Recover on changed original: %v", err)
+	}
+	if err := b.StopJournal(); err != nil {
+		t.Fatalf("TestJournal: StopJournal: %v", err)
+	}
+}
+
+func TestEditScript(t *testing.T) {
+	orig, _ := os.CreateTemp("", "TESTFILE")
+	defer os.Remove(orig.Name())
+	orig.Write(testdata)
+	orig.Close()
+
+	b, err := OpenFile(orig.Name(), WithHash())
+	if err != nil {
+		t.Fatalf("TestEditScript: OpenFile: %v", err)
+	}
+	defer b.Close()
+	if err := b.StartRecording(); err != nil {
+		t.Fatalf("TestEditScript: StartRecording: %v", err)
+	}
+	b.Paste(b.Size(), b.Copy(2, 20))
+	for i, c := range []byte("typed") {
+		b.Insert1(7+int64(i), c)
+	}
+	b.Remove(11, 1)
+	b.Remove(10, 1)
+	b.InsertFill(2, []byte("abc"), 10)
+	b.Seek(20, io.SeekStart)
+	b.Write(testdata_line2)
+	b.Remove(30, 12)
+	b.Fill(4, 9, []byte{0xde, 0xad})
+	b.Paste(0, b.Copy(5, 30))
+	s := b.StopRecording()
+	want := readAll(b)
+
+	bin, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("TestEditScript: MarshalBinary: %v", err)
+	}
+	js, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("TestEditScript: MarshalJSON: %v", err)
+	}
+	if !bytes.Contains(js, []byte(`"op":"copy"`)) {
+		t.Fatalf("TestEditScript: the pasted original isn't a copy: %s", js)
+	}
+	var fromBin, fromJSON EditScript
+	if err := fromBin.UnmarshalBinary(bin); err != nil {
+		t.Fatalf("TestEditScript: UnmarshalBinary: %v", err)
+	}
+	if err := json.Unmarshal(js, &fromJSON); err != nil {
+		t.Fatalf("TestEditScript: UnmarshalJSON: %v", err)
+	}
+	other := tempFile(t, bytes.ToUpper(testdata))
+	for _, s := range []*EditScript{s, &fromBin, &fromJSON} {
+		r, _ := OpenFile(orig.Name())
+		if err := r.Replay(s); err != nil {
+			t.Fatalf("TestEditScript: Replay: %v", err)
+		}
+		if !compareBuf2Bytes(r, want) {
+			t.Fatal("TestEditScript: replayed buffer != edited buffer")
+		}
+		r.Close()
+		//same size, other contents
+		r, _ = OpenFile(other)
+		if err := r.Replay(s); err == nil {
+			t.Fatal("TestEditScript: replayed on another original")
+		}
+		r.Close()
+	}
+
+	//pieces in the scratch file can be marshalled after Close
+	sp := NewMem(nil)
+	sp.Insert(0, testdata)
+	sp.Insert(0, helloworld)
+	sp.SetMemoryLimit(1)
+	sp.StartRecording()
+	sp.Paste(0, sp.Copy(0, sp.Size()))
+	spilled := sp.StopRecording()
+	sp.Close()
+	if _, err := spilled.MarshalBinary(); err != nil {
+		t.Fatalf("TestEditScript: spilled pieces after Close: %v", err)
+	}
+
+	//typing and backspacing are one edit each
+	m := NewMem(testdata)
+	m.StartRecording()
+	for i, c := range []byte("macro") {
+		m.Insert1(int64(i), c)
+	}
+	m.Remove(4, 1)
+	m.Remove(3, 1)
+	macro := m.StopRecording()
+	if macro.Len() != 2 {
+		t.Fatalf("TestEditScript: macro has %d edits", macro.Len())
+	}
+	m = NewMem(helloworld)
+	if err := m.Replay(macro); err != nil || string(readAll(m)) != "mac"+string(helloworld) {
+		t.Fatalf("TestEditScript: replayed macro: %v", err)
+	}
+
+	//a script that doesn't fit changes nothing
+	m = NewMem(helloworld)
+	if err := m.Replay(s); err == nil || !compareBuf2Bytes(m, helloworld) {
+		t.Fatalf("TestEditScript: replay on another buffer: %v", err)
+	}
+	if err := fromBin.UnmarshalBinary(bin[:len(bin)-1]); !errors.Is(err, ErrBadScript) {
+		t.Fatalf("TestEditScript: truncated script: %v", err)
+	}
+}
+
+func TestCheckBackingReload(t *testing.T) {
+	f, _ := os.CreateTemp("", "TESTFILE")
+	defer os.Remove(f.Name())
+	f.Write(testdata)
+	f.Close()
+
+	b, err := OpenFile(f.Name(), WithHash())
+	if err != nil {
+		t.Fatalf("TestCheckBackingReload: OpenFile: %v", err)
+	}
+	if err := b.CheckBacking(); err != nil {
+		t.Fatalf("TestCheckBackingReload: untouched file: %v", err)
+	}
+	changed := make(chan error, 10)
+	watching := b.Watch(func(err error) { changed <- err }) == nil
+	b.Insert(0, helloworld)
+
+	//same size, only the hash can tell
+	newdata := bytes.ToUpper(testdata)
+	os.WriteFile(f.Name(), newdata, 0600)
+	if err := b.CheckBacking(); !errors.Is(err, ErrBackingChanged) {
+		t.Fatalf("TestCheckBackingReload: changed file: %v", err)
+	}
+	if watching {
+		select {
+		case err := <-changed:
+			if !errors.Is(err, ErrBackingChanged) {
+				t.Fatalf("TestCheckBackingReload: watch reported: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("TestCheckBackingReload: watch didn't notice the change")
+		}
+		b.Unwatch()
+	}
+
+	if err := b.Reload(true); err != nil {
+		t.Fatalf("TestCheckBackingReload: Reload(true): %v", err)
+	}
+	if !compareBuf2Bytes(b, append(append([]byte{}, helloworld...), newdata...)) {
+		t.Fatal("TestCheckBackingReload: edits weren't re-applied")
+	}
+	if err := b.CheckBacking(); err != nil {
+		t.Fatalf("TestCheckBackingReload: after reload: %v", err)
+	}
+
+	os.WriteFile(f.Name(), testdata_line2, 0600)
+	if err := b.Reload(false); err != nil {
+		t.Fatalf("TestCheckBackingReload: Reload(false): %v", err)
+	}
+	if !compareBuf2Bytes(b, testdata_line2) {
+		t.Fatal("TestCheckBackingReload: reloaded buffer != file")
+	}
+}
+
+func TestNewFromReaderAt(t *testing.T) {
+	want := append(append([]byte{}, helloworld...), testdata...)
+	want = append(want, testdata_line2...)
+	for _, r := range []io.ReaderAt{
+		bytes.NewReader(testdata),
+		io.NewSectionReader(bytes.NewReader(want), int64(len(helloworld)), int64(len(testdata))),
+		NewCachedReaderAt(bytes.NewReader(testdata), 7, 3),
+	} {
+		b := NewFromReaderAt(r, int64(len(testdata)))
+		if !compareBuf2Bytes(b, testdata) {
+			t.Fatalf("TestNewFromReaderAt: buffer != source (%T)", r)
+		}
+		b.Insert(0, helloworld)
+		b.Insert(b.Size(), testdata_line2)
+		if !compareBuf2Bytes(b, want) {
+			t.Fatalf("TestNewFromReaderAt: buffer wrong after edits (%T)", r)
+		}
+	}
+}
+
+func TestNewFromReader(t *testing.T) {
+	//big enough to end up in a temporary file
+	big := bytes.Repeat(testdata, int(spoolMemLimit)/len(testdata)*2)
+	r, w := io.Pipe()
+	b := NewFromReader(r)
+	b.StartRecording()
+
+	w.Write(helloworld)
+	for b.Size() < int64(len(helloworld)) {
+		time.Sleep(time.Millisecond)
+	}
+	if !b.Streaming() {
+		t.Fatal("TestNewFromReader: stream finished too early")
+	}
+	//edit the start while the rest is still coming in
+	b.Remove(0, 6)
+	b.Insert(0, []byte("Goodbye "))
+
+	go func() {
+		w.Write(big)
+		w.Close()
+	}()
+	if err := b.WaitStream(); err != nil {
+		t.Fatalf("TestNewFromReader: WaitStream: %v", err)
+	}
+	want := append([]byte("Goodbye World!\n"), big...)
+	b.Seek(0, io.SeekStart)
+	got, _ := io.ReadAll(b)
+	if !bytes.Equal(got, want) {
+		t.Fatal("TestNewFromReader: buffer != stream")
+	}
+	//what came in was recorded
+	replayed := NewEmpty()
+	if err := replayed.Replay(b.StopRecording()); err != nil || !compareBuf2Bytes(replayed, want) {
+		t.Fatalf("TestNewFromReader: replayed stream: %v", err)
+	}
+
+	//closing the buffer leaves the reader open,
+	//reading stops once the caller closes it
+	r, w = io.Pipe()
+	cr := &trackedCloser{Reader: r}
+	b = NewFromReader(cr)
+	w.Write(helloworld)
+	b.Close()
+	if cr.closed {
+		t.Fatal("TestNewFromReader: Close closed the reader")
+	}
+	r.Close()
+	stopped := make(chan error)
+	go func() { stopped <- b.WaitStream() }()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TestNewFromReader: still reading after the reader was closed")
+	}
+}
+
+//remembers if it was closed
+type trackedCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (c *trackedCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFill(t *testing.T) {
+	b := NewMem(testdata)
+	const big = 1 << 40
+	if err := b.InsertFill(10, []byte{0xff}, big); err != nil {
+		t.Fatalf("TestFill: InsertFill: %v", err)
+	}
+	if b.Size() != int64(len(testdata))+big {
+		t.Fatalf("TestFill: size %d after InsertFill", b.Size())
+	}
+	if st := b.Stats(); st.FillBytes != big || st.MemBytes > int64(len(testdata)) {
+		t.Fatalf("TestFill: fill takes memory?\n%v", st)
+	}
+	b.Remove(20, big-20)
+
+	want := append([]byte{}, testdata[:10]...)
+	want = append(want, bytes.Repeat([]byte{0xff}, 20)...)
+	want = append(want, testdata[10:]...)
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestFill: contents wrong after InsertFill")
+	}
+
+	//overwrite, across the end of the buffer
+	pattern := []byte("0123456789")
+	off := int64(len(want) - 5)
+	if err := b.Fill(off, 23, pattern); err != nil {
+		t.Fatalf("TestFill: Fill: %v", err)
+	}
+	want = append(want[:off], "01234567890123456789012"...)
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestFill: contents wrong after Fill")
+	}
+
+	//writing past the end leaves a gap of zeroes, writing nothing doesn't
+	if _, err := b.Seek(100, io.SeekEnd); err != nil {
+		t.Fatalf("TestFill: Seek past end: %v", err)
+	}
+	if n, err := b.Write(nil); n != 0 || err != nil || b.Size() != int64(len(want)) {
+		t.Fatalf("TestFill: empty Write past end: %d, %v, size %d", n, err, b.Size())
+	}
+	if _, err := b.Write(helloworld); err != nil {
+		t.Fatalf("TestFill: Write past end: %v", err)
+	}
+	want = append(append(want, make([]byte, 100)...), helloworld...)
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestFill: contents wrong after writing past the end")
+	}
+	var dumped bytes.Buffer
+	b.Dump(&dumped)
+	if !bytes.Equal(dumped.Bytes(), want) {
+		t.Fatal("TestFill: Dump went wrong")
+	}
+}
+
+func TestHash(t *testing.T) {
+	name := tempFile(t, bytes.Repeat(testdata, 300))
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestHash: OpenFile: %v", err)
+	}
+	defer b.Close()
+	b.Insert(100000, helloworld)
+	b.InsertFill(20, []byte("abc"), 1000001)
+	b.Remove(300, 10)
+
+	check := func(what string) {
+		b.Seek(0, io.SeekStart)
+		contents, _ := io.ReadAll(b)
+		for _, r := range [][2]int64{{0, b.Size()}, {0, 0}, {25, 70000}, {150000, b.Size() - 1}} {
+			want := sha256.Sum256(contents[r[0]:r[1]])
+			got, err := b.Hash(sha256.New(), r[0], r[1])
+			if err != nil || !bytes.Equal(got, want[:]) {
+				t.Fatalf("TestHash(%s): sha256 of %v wrong (%v)", what, r, err)
+			}
+			crc, err := b.CRC32(r[0], r[1])
+			if err != nil || crc != crc32.ChecksumIEEE(contents[r[0]:r[1]]) {
+				t.Fatalf("TestHash(%s): crc32 of %v wrong (%v)", what, r, err)
+			}
+		}
+	}
+	check("no cache")
+	b.SetChecksumCache(100)
+	check("cache")
+	b.Insert(500000, helloworld)
+	b.Remove(70000, 70000)
+	check("cache after edits")
+
+	if _, err := b.Hash(sha256.New(), 10, b.Size()+1); err == nil {
+		t.Fatal("TestHash: range past the end should fail")
+	}
+}
+
+func TestContext(t *testing.T) {
+	b := NewMem(bytes.Repeat(testdata, 100))
+	b.InsertFill(1000, []byte{0}, 200000)
+	b.Insert(1000+200000-3, []byte("needle"))
+	b.Seek(0, io.SeekStart)
+	contents, _ := io.ReadAll(b)
+
+	//search across pieces and chunks
+	for _, from := range []int64{0, 500, 200997, 200998} {
+		want := bytes.Index(contents[from:], []byte("needle"))
+		if want >= 0 {
+			want += int(from)
+		}
+		if got := b.Index([]byte("needle"), from); got != int64(want) {
+			t.Fatalf("TestContext: Index from %d: %d, should be %d", from, got, want)
+		}
+	}
+
+	var done, total int64
+	progress := func(d, t int64) { done, total = d, t }
+	b.Seek(10, io.SeekStart)
+	var out bytes.Buffer
+	n, err := b.WriteToContext(context.Background(), &out, progress)
+	if err != nil || n != b.Size()-10 || !bytes.Equal(out.Bytes(), contents[10:]) {
+		t.Fatalf("TestContext: WriteToContext wrote %d bytes (%v)", n, err)
+	}
+	if done != total || total != n {
+		t.Fatalf("TestContext: progress %d/%d", done, total)
+	}
+
+	//cancelled halfway
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := func(d, t int64) {
+		if d > t/2 {
+			cancel()
+		}
+	}
+	if _, err := b.IndexContext(ctx, []byte("not in there"), 0, stop); !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestContext: IndexContext not cancelled: %v", err)
+	}
+	name := tempFile(t, testdata)
+	if err := b.SaveAsContext(ctx, name, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("TestContext: SaveAsContext not cancelled: %v", err)
+	}
+	checkFile(t, name, testdata)
+}
+
+func TestModifiedRanges(t *testing.T) {
+	one, two := bytes.Repeat([]byte("1"), 10000), bytes.Repeat([]byte("2"), 5000)
+	b, err := OpenFiles([]string{tempFile(t, one), tempFile(t, two)})
+	if err != nil {
+		t.Fatalf("TestModifiedRanges: %v", err)
+	}
+	defer b.Close()
+	if r := b.ModifiedRanges(); len(r) != 0 || !b.IsOriginal(12000) {
+		t.Fatalf("TestModifiedRanges: unmodified buffer has %v", r)
+	}
+	b.Seek(100, io.SeekStart)
+	b.Write([]byte("xyz"))
+	b.Remove(12000, 10)
+	b.Paste(12000, b.Copy(500, 10))
+	want := []Provenance{{100, 3, Inserted, 0}, {12000, 10, Moved, 500}}
+	if r := b.ModifiedRanges(); !reflect.DeepEqual(r, want) {
+		t.Fatalf("TestModifiedRanges: %v, should be %v", r, want)
+	}
+	for off, orig := range map[int64]bool{99: true, 100: false, 12005: false, 12010: true, 14999: true, 15000: false} {
+		if b.IsOriginal(off) != orig {
+			t.Errorf("TestModifiedRanges: IsOriginal(%d) should be %v", off, orig)
+		}
+	}
+
+	//everything after an insert moved
+	b = NewFromReaderAt(bytes.NewReader(testdata), int64(len(testdata)))
+	b.Insert(0, helloworld)
+	want = []Provenance{{0, int64(len(helloworld)), Inserted, 0}, {int64(len(helloworld)), int64(len(testdata)), Moved, 0}}
+	if r := b.ModifiedRanges(); !reflect.DeepEqual(r, want) {
+		t.Fatalf("TestModifiedRanges: %v, should be %v", r, want)
+	}
+
+	//pieces of another buffer are inserted, also without an original
+	other := NewFromReaderAt(bytes.NewReader(testdata), int64(len(testdata)))
+	b.Paste(0, other.Copy(0, 10))
+	want = []Provenance{{0, 10 + int64(len(helloworld)), Inserted, 0}, {10 + int64(len(helloworld)), int64(len(testdata)), Moved, 0}}
+	if r := b.ModifiedRanges(); !reflect.DeepEqual(r, want) {
+		t.Fatalf("TestModifiedRanges: paste from another buffer: %v, should be %v", r, want)
+	}
+	b = NewEmpty()
+	b.Paste(0, other.Copy(0, 10))
+	want = []Provenance{{0, 10, Inserted, 0}}
+	if r := b.ModifiedRanges(); !reflect.DeepEqual(r, want) || b.IsOriginal(0) {
+		t.Fatalf("TestModifiedRanges: paste into an empty buffer: %v, should be %v", r, want)
+	}
+}
+
+func TestMapOffsets(t *testing.T) {
+	src := bytes.Repeat(testdata, 10)
+	b := NewFromReaderAt(bytes.NewReader(src), int64(len(src)))
+	b.Remove(100, 50)
+	b.Insert(10, []byte("abc"))
+	b.Paste(b.Size(), b.Copy(0, 5))
+
+	for _, m := range []struct {
+		orig, cur int64
+		ok        bool
+	}{{5, 5, true}, {20, 23, true}, {120, 103, false}, {150, 103, true}, {int64(len(src)), int64(len(src)) - 47, false}} {
+		if cur, ok := b.MapOriginalToCurrent(m.orig); cur != m.cur || ok != m.ok {
+			t.Errorf("TestMapOffsets: MapOriginalToCurrent(%d) = %d, %v, should be %d, %v", m.orig, cur, ok, m.cur, m.ok)
+		}
+	}
+	for _, m := range []struct {
+		cur, orig int64
+		ok        bool
+	}{{5, 5, true}, {11, 0, false}, {23, 20, true}, {103, 150, true}, {b.Size() - 1, 4, true}, {b.Size(), 0, false}} {
+		if orig, ok := b.MapCurrentToOriginal(m.cur); orig != m.orig || ok != m.ok {
+			t.Errorf("TestMapOffsets: MapCurrentToOriginal(%d) = %d, %v, should be %d, %v", m.cur, orig, ok, m.orig, m.ok)
+		}
+	}
+}
+
 func TestMemBufVsOtherImplementation(t *testing.T) {
 	//R2 seems solid
 	b := NewEmpty()
@@ -3,8 +3,10 @@ module github.com/snhmibby/filebuf
 go 1.17
 
 require (
+	github.com/dsnet/compress v0.0.1
 	github.com/eaburns/T v0.0.0-20190217122806-dbc7887ff15c
 	github.com/fvbommel/util v0.0.3
+	github.com/klauspost/compress v1.15.15
 	github.com/vinzmay/go-rope v0.0.0-20140903160433-d4b1498b37c3
 	github.com/zyedidia/rope v0.0.0-20210616205215-37fbf22eab3a
 	golang.org/x/exp v0.0.0-20210903233438-a2d0902c3ac7
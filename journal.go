@@ -0,0 +1,471 @@
+package filebuf
+
+/* Journal
+   A journal records every edit on a Buffer, together with the inserted bytes,
+   like the swap file of vim. After a crash, Recover replays the journal on top
+   of the original file to get back the exact edited state.
+
+   Layout of a journal file:
+     header: "FBJ1" | uvarint len(path) | path | varint size | varint mtime | compression | crc32
+     record: op | uvarint offset | uvarint size | [src, data or pattern] | crc32
+     a pattern (opFill) is stored as uvarint len(pattern) | pattern
+
+   Each record is flushed to the OS before the edit returns, so a crash of the
+   program never loses an edit (use SyncJournal to survive a crash of the OS).
+   A torn record at the end of the journal is simply ignored, a damaged
+   record before the end makes Recover fail.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//Recover returns this error if the original file was changed after the journal was started
+var ErrOriginalChanged = errors.New("filebuf: original file changed since the journal was started")
+
+//Recover returns this error if a record that isn't the last one is damaged
+var ErrCorruptJournal = errors.New("filebuf: corrupt journal")
+
+var journalMagic = []byte("FBJ1")
+
+type editOp byte
+
+const (
+	opInsert editOp = iota + 1 //insert size bytes at off
+	opDelete                   //delete size bytes at off
+	opCopy                     //insert size bytes of the original file, starting at src, at off
+	opFill                     //insert size bytes of a repeating pattern at off
+)
+
+//an edit on a buffer, as it is recorded
+type edit struct {
+	op   editOp
+	off  int64
+	size int64
+	src  int64   //offset in the original (opCopy)
+	data []byte  //inserted bytes (opInsert) or the pattern (opFill), or
+	tree *Buffer //a tree holding the inserted bytes (opInsert)
+}
+
+type journal struct {
+	file *os.File
+	w    *bufio.Writer
+	err  error //first error that happened, sticky
+}
+
+//is anybody interested in the edits on this buffer?
+func (fb *Buffer) recording() bool {
+	return fb.journal != nil || fb.script != nil
+}
+
+//tell whoever is interested about an edit
+func (fb *Buffer) record(e *edit) error {
+	if fb.script != nil {
+		fb.script.add(fb, e)
+	}
+	if fb.journal != nil {
+		return fb.journal.write(e)
+	}
+	return nil
+}
+
+//StartJournal records all subsequent edits of fb in a journal file at path
+//If fb was already edited, its current state is written to the journal first.
+func (fb *Buffer) StartJournal(path string) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.journal != nil {
+		return errors.New("filebuf: journal already started")
+	}
+	if len(fb.backing) > 1 {
+		return errors.New("filebuf: can't journal a buffer of multiple files")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	j := &journal{file: f, w: bufio.NewWriter(f)}
+	j.start(fb)
+	if j.err != nil {
+		f.Close()
+		os.Remove(path)
+		return j.err
+	}
+	fb.journal = j
+	return nil
+}
+
+//StopJournal stops journaling and removes the journal file
+//It returns the first error that occurred while writing the journal, if any.
+func (fb *Buffer) StopJournal() error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	j := fb.journal
+	if j == nil {
+		return nil
+	}
+	fb.journal = nil
+	err := j.err
+	j.file.Close()
+	if e := os.Remove(j.file.Name()); err == nil {
+		err = e
+	}
+	return err
+}
+
+//SyncJournal commits the journal to stable storage
+func (fb *Buffer) SyncJournal() error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.journal == nil {
+		return nil
+	}
+	if fb.journal.err != nil {
+		return fb.journal.err
+	}
+	return fb.journal.file.Sync()
+}
+
+//Recover reconstructs the state of an edited buffer from the journal at
+//journalPath, on top of the original file at originalPath.
+//If the original was changed since the journal was started, ErrOriginalChanged is returned,
+//if a record before the last one is damaged, ErrCorruptJournal.
+func Recover(journalPath, originalPath string) (*Buffer, error) {
+	f, err := os.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	path, size, mtime, format, err := readJournalHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fb := NewEmpty()
+	if path != "" {
+		info, err := os.Stat(originalPath)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != size || info.ModTime().UnixNano() != mtime {
+			return nil, fmt.Errorf("%w: %s", ErrOriginalChanged, originalPath)
+		}
+		if format == NoCompression {
+			fb, err = OpenFile(originalPath)
+		} else {
+			fb, err = OpenCompressed(originalPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	orig := fb.copy(0, fb.size())
+	for {
+		e, err := readEdit(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			//end of the journal, or a torn record
+			break
+		}
+		if err != nil {
+			if _, more := r.Peek(1); more == nil {
+				return nil, fmt.Errorf("%w: %v", ErrCorruptJournal, err)
+			}
+			//garbage in the last record, torn as well
+			break
+		}
+		if err = fb.replay(e, orig); err != nil {
+			return nil, err
+		}
+	}
+	return fb, nil
+}
+
+//apply a recorded edit, orig holds the original contents for opCopy
+func (fb *Buffer) replay(e *edit, orig *Buffer) error {
+	if e.off < 0 || e.size < 0 || e.off > fb.size() {
+		return fmt.Errorf("filebuf: bad edit in journal (offset %d, size %d)", e.off, e.size)
+	}
+	switch e.op {
+	case opInsert:
+		if e.tree != nil {
+			fb.paste(e.off, e.tree)
+			return nil
+		}
+		return fb.insert(e.off, e.data)
+	case opDelete:
+		if e.off+e.size > fb.size() {
+			return fmt.Errorf("filebuf: bad delete in journal (offset %d, size %d)", e.off, e.size)
+		}
+		fb.remove(e.off, e.size)
+	case opCopy:
+		if e.src < 0 || e.src+e.size > orig.size() {
+			return fmt.Errorf("filebuf: bad copy in journal (src %d, size %d)", e.src, e.size)
+		}
+		fb.paste(e.off, orig.copy(e.src, e.size))
+	case opFill:
+		return fb.insertFill(e.off, e.data, e.size)
+	default:
+		return fmt.Errorf("filebuf: unknown edit in journal (%d)", e.op)
+	}
+	return nil
+}
+
+//write the header and the current state of fb
+func (j *journal) start(fb *Buffer) {
+	var orig *backing
+	if len(fb.backing) == 1 {
+		orig = fb.backing[0]
+	}
+	j.writeHeader(orig)
+	j.snapshot(fb, orig)
+}
+
+//start over, because the original file changed (the buffer was reloaded or saved)
+func (j *journal) reset(fb *Buffer) error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		j.err = err
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		j.err = err
+		return err
+	}
+	j.err = nil
+	j.w.Reset(j.file)
+	j.start(fb)
+	return j.err
+}
+
+func (j *journal) writeHeader(orig *backing) {
+	var path string
+	var size, mtime int64
+	var format Compression
+	if orig != nil {
+		path, size, mtime, format = orig.path, orig.size, orig.mtime.UnixNano(), orig.format
+	}
+	hdr := append([]byte{}, journalMagic...)
+	hdr = appendUvarint(hdr, uint64(len(path)))
+	hdr = append(hdr, path...)
+	hdr = appendVarint(hdr, size)
+	hdr = appendVarint(hdr, mtime)
+	hdr = append(hdr, byte(format))
+	hdr = appendUint32(hdr, crc32.ChecksumIEEE(hdr))
+	j.w.Write(hdr)
+	j.err = j.w.Flush()
+}
+
+//write the current state of fb, relative to the original file
+func (j *journal) snapshot(fb *Buffer, orig *backing) {
+	var origsize int64
+	if orig != nil {
+		origsize = orig.length
+	}
+	j.write(&edit{op: opDelete, off: 0, size: origsize})
+
+	var off int64
+	fb.root.iter(func(n *node) bool {
+		sz := n.data.Size()
+		if sz == 0 {
+			return false
+		}
+		if orig != nil && orig.owns(n.data) {
+			_, src, _ := fileSource(n.data)
+			j.write(&edit{op: opCopy, off: off, size: sz, src: src})
+		} else if f, ok := n.data.(*fillData); ok {
+			j.write(&edit{op: opFill, off: off, size: sz, data: f.rotated()})
+		} else {
+			j.write(&edit{op: opInsert, off: off, size: sz, tree: &Buffer{root: mkNode(n.data)}})
+		}
+		off += sz
+		return j.err != nil
+	})
+}
+
+func (j *journal) write(e *edit) error {
+	if j.err != nil {
+		return j.err
+	}
+	if j.err = writeEdit(j.w, e); j.err == nil {
+		j.err = j.w.Flush()
+	}
+	return j.err
+}
+
+//write a record for e to out, errors of out are left to the caller
+func writeEdit(out io.Writer, e *edit) error {
+	crc := crc32.NewIEEE()
+	w := &countWriter{w: io.MultiWriter(out, crc)}
+
+	hdr := []byte{byte(e.op)}
+	hdr = appendUvarint(hdr, uint64(e.off))
+	hdr = appendUvarint(hdr, uint64(e.size))
+	switch e.op {
+	case opCopy:
+		hdr = appendUvarint(hdr, uint64(e.src))
+	case opFill:
+		hdr = appendUvarint(hdr, uint64(len(e.data)))
+		hdr = append(hdr, e.data...)
+	}
+	w.Write(hdr)
+	if e.op == opInsert {
+		if e.tree != nil {
+			e.tree.dump(w)
+		} else {
+			w.Write(e.data)
+		}
+		if w.n != int64(len(hdr))+e.size {
+			return fmt.Errorf("filebuf: couldn't write inserted data")
+		}
+	}
+	out.Write(appendUint32(nil, crc.Sum32()))
+	return nil
+}
+
+func readJournalHeader(r *bufio.Reader) (path string, size, mtime int64, format Compression, err error) {
+	cr := &crcReader{r: r, crc: crc32.NewIEEE()}
+	magic := make([]byte, len(journalMagic))
+	if _, err = io.ReadFull(cr, magic); err != nil {
+		return
+	}
+	if !bytes.Equal(magic, journalMagic) {
+		err = errors.New("filebuf: not a journal file")
+		return
+	}
+	var plen uint64
+	if plen, err = binary.ReadUvarint(cr); err != nil {
+		return
+	}
+	p := &bytes.Buffer{}
+	if _, err = io.CopyN(p, cr, int64(plen)); err != nil {
+		return
+	}
+	if size, err = binary.ReadVarint(cr); err != nil {
+		return
+	}
+	if mtime, err = binary.ReadVarint(cr); err != nil {
+		return
+	}
+	var f byte
+	if f, err = cr.ReadByte(); err != nil {
+		return
+	}
+	if err = cr.check(); err != nil {
+		return
+	}
+	return p.String(), size, mtime, Compression(f), nil
+}
+
+func readEdit(r *bufio.Reader) (*edit, error) {
+	cr := &crcReader{r: r, crc: crc32.NewIEEE()}
+	op, err := cr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e := &edit{op: editOp(op)}
+	off, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, err
+	}
+	e.off, e.size = int64(off), int64(size)
+	switch e.op {
+	case opCopy:
+		src, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		e.src = int64(src)
+	case opInsert:
+		//don't trust size to allocate a buffer, the record might be garbage
+		b := &bytes.Buffer{}
+		if _, err := io.CopyN(b, cr, e.size); err != nil {
+			return nil, err
+		}
+		e.data = b.Bytes()
+	case opFill:
+		plen, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, err
+		}
+		b := &bytes.Buffer{}
+		if _, err := io.CopyN(b, cr, int64(plen)); err != nil {
+			return nil, err
+		}
+		e.data = b.Bytes()
+	}
+	return e, cr.check()
+}
+
+//reads through r and keeps a running checksum
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+//read a checksum from the underlying reader and compare it
+func (c *crcReader) check() error {
+	var sum [4]byte
+	if _, err := io.ReadFull(c.r, sum[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != c.crc.Sum32() {
+		return errors.New("filebuf: checksum mismatch in journal")
+	}
+	return nil
+}
+
+//counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
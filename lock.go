@@ -0,0 +1,60 @@
+package filebuf
+
+import (
+	"errors"
+	"os"
+)
+
+//ErrLocked is returned (wrapped) when another process holds a conflicting lock on a file
+var ErrLocked = errors.New("filebuf: file is locked by another process")
+
+//LockMode is the kind of advisory lock (flock) taken on a backing file
+type LockMode int
+
+const (
+	LockNone      LockMode = iota //don't lock
+	LockShared                    //others may read, but not save
+	LockExclusive                 //others may not even read
+)
+
+//WithLock makes OpenFile (and OpenFiles, OpenCompressed) take an advisory lock on the file, without waiting for it
+//The lock is upgraded to an exclusive lock while saving and released by Close.
+//If another process holds a conflicting lock, an error wrapping ErrLocked is returned.
+func WithLock(mode LockMode) OpenOption {
+	return func(c *openConfig) {
+		c.lock = mode
+	}
+}
+
+//the file on disk b reads from, a compressed file is read through a seekableReader
+func (b *backing) osFile() (*os.File, bool) {
+	switch f := b.file.(type) {
+	case *os.File:
+		return f, true
+	case *seekableReader:
+		return f.file, true
+	}
+	return nil, false
+}
+
+//(re)lock the backing file in mode
+func (b *backing) lockAs(mode LockMode) error {
+	f, ok := b.osFile()
+	if !ok || mode == LockNone {
+		return nil
+	}
+	if err := lockFile(f, mode); err != nil {
+		return err
+	}
+	b.lock = mode
+	return nil
+}
+
+func (b *backing) unlock() error {
+	f, ok := b.osFile()
+	if !ok || b.lock == LockNone {
+		return nil
+	}
+	b.lock = LockNone
+	return unlockFile(f)
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package filebuf
+
+import (
+	"errors"
+	"os"
+)
+
+//take an advisory lock on f, without waiting for it
+func lockFile(f *os.File, mode LockMode) error {
+	return errors.New("filebuf: file locking is not supported on this platform")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
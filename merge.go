@@ -0,0 +1,151 @@
+package filebuf
+
+/* Three-way merge
+   Both versions are diffed against the base, pieces they share with it are
+   found without reading them (see Diff). The changes of both sides are
+   sorted on where they are in the base and grouped when they overlap or
+   start at the same place. A group with changes of one side only takes that
+   side, a group with changes of both is a conflict, unless both did the same.
+   The merged buffer is built from pieces of the three buffers.
+*/
+
+import (
+	"bytes"
+	"sort"
+)
+
+//Span is a range of bytes in a buffer
+type Span struct {
+	Offset, Size int64
+}
+
+//Conflict is a range where ours and theirs both changed the base, differently
+//The merged buffer holds our version there.
+type Conflict struct {
+	Merged, Base, Ours, Theirs Span
+}
+
+//a change of one side
+type sideChange struct {
+	change
+	theirs bool
+}
+
+//Merge merges the changes from base to ours and from base to theirs
+//The buffers are only locked while their trees are copied.
+func Merge(base, ours, theirs *Buffer) (*Buffer, []Conflict, error) {
+	base, ours, theirs = base.snapshot(), ours.snapshot(), theirs.snapshot()
+	dOurs, err := diff(base, ours)
+	if err != nil {
+		return nil, nil, err
+	}
+	dTheirs, err := diff(base, theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var changes []sideChange
+	for _, c := range byteChanges(dOurs, base.size(), ours.size()) {
+		changes = append(changes, sideChange{c, false})
+	}
+	for _, c := range byteChanges(dTheirs, base.size(), theirs.size()) {
+		changes = append(changes, sideChange{c, true})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].a0 < changes[j].a0 || (changes[i].a0 == changes[j].a0 && changes[i].a1 < changes[j].a1)
+	})
+
+	b := mkBuilder()
+	var conflicts []Conflict
+	var pos int64 //in base
+	for len(changes) > 0 {
+		//the changes that overlap
+		g0, g1 := changes[0].a0, changes[0].a1
+		n := 1
+		for ; n < len(changes); n++ {
+			c := changes[n]
+			if c.a0 >= g1 && c.a0 != changes[n-1].a0 {
+				break
+			}
+			if c.a1 > g1 {
+				g1 = c.a1
+			}
+		}
+		group := changes[:n]
+		changes = changes[n:]
+
+		if err := b.copy(base, pos, g0-pos); err != nil {
+			return nil, nil, err
+		}
+		pos = g1
+		o, ourOK := sideSpan(group, false, g0, g1)
+		t, theirOK := sideSpan(group, true, g0, g1)
+		if !ourOK {
+			//only they changed this
+			if err := b.copy(theirs, t.Offset, t.Size); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err := b.copy(ours, o.Offset, o.Size); err != nil {
+			return nil, nil, err
+		}
+		if !theirOK {
+			continue
+		}
+		same, err := sameBytes(ours, o, theirs, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !same {
+			conflicts = append(conflicts, Conflict{
+				Merged: Span{b.size() - o.Size, o.Size},
+				Base:   Span{g0, g1 - g0},
+				Ours:   o,
+				Theirs: t,
+			})
+		}
+	}
+	if err := b.copy(base, pos, base.size()-pos); err != nil {
+		return nil, nil, err
+	}
+	return b.out, conflicts, nil
+}
+
+//what one side turned [g0, g1) of the base into, false if it didn't change it
+func sideSpan(group []sideChange, theirs bool, g0, g1 int64) (Span, bool) {
+	var first, last *sideChange
+	for i := range group {
+		if group[i].theirs == theirs {
+			if first == nil {
+				first = &group[i]
+			}
+			last = &group[i]
+		}
+	}
+	if first == nil {
+		return Span{}, false
+	}
+	//the base before the first change and after the last one is unchanged
+	start := first.b0 - (first.a0 - g0)
+	end := last.b1 + (g1 - last.a1)
+	return Span{start, end - start}, true
+}
+
+//whether x in a and y in b hold the same bytes
+func sameBytes(a *Buffer, x Span, b *Buffer, y Span) (bool, error) {
+	if x.Size != y.Size {
+		return false, nil
+	}
+	for off := int64(0); off < x.Size; off += iterChunk {
+		n := minInt64(iterChunk, x.Size-off)
+		p, err := a.bytes(x.Offset+off, n)
+		if err != nil {
+			return false, err
+		}
+		q, err := b.bytes(y.Offset+off, n)
+		if err != nil || !bytes.Equal(p, q) {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,58 @@
+package filebuf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	src := bytes.Repeat(testdata, 5000)
+	cr := &countingReaderAt{r: bytes.NewReader(src)}
+	base := NewFromReaderAt(cr, int64(len(src)))
+	ours := base.Copy(0, base.Size())
+	ours.Remove(200000, 500)
+	ours.Insert(1000, helloworld)
+	theirs := base.Copy(0, base.Size())
+	theirs.Fill(300000, 100, []byte("x"))
+	theirs.Insert(100000, helloworld)
+
+	merged, conflicts, err := Merge(base, ours, theirs)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("TestMerge: %v, conflicts %v", err, conflicts)
+	}
+	if cr.n > 1000 {
+		t.Errorf("TestMerge: read %d bytes of the base", cr.n)
+	}
+	want := append([]byte{}, src...)
+	copy(want[300000:], bytes.Repeat([]byte("x"), 100))
+	want = append(want[:200000], want[200500:]...)
+	want = append(want[:100000], append(append([]byte{}, helloworld...), want[100000:]...)...)
+	want = append(want[:1000], append(append([]byte{}, helloworld...), want[1000:]...)...)
+	if !bytes.Equal(readAll(merged), want) {
+		t.Fatal("TestMerge: merged buffer is wrong")
+	}
+
+	for _, c := range []struct {
+		base, ours, theirs, merged string
+		conflicts                  []Conflict
+	}{
+		{"abcdefgh", "abXdefgh", "abcdefYh", "abXdefYh", nil},
+		{"abcdefgh", "abXYefgh", "abXYefgh", "abXYefgh", nil},
+		{"abcdefgh", "abcdgh", "abcdefghZ", "abcdghZ", nil},
+		{"abcdefgh", "abXXgh", "abcYYYgh", "abXXgh", []Conflict{{Span{2, 2}, Span{2, 4}, Span{2, 2}, Span{2, 4}}}},
+		{"abcdefgh", "abcdOURSefgh", "abcdTHEIRSefgh", "abcdOURSefgh", []Conflict{{Span{4, 4}, Span{4, 0}, Span{4, 4}, Span{4, 6}}}},
+	} {
+		merged, conflicts, err := Merge(NewMem([]byte(c.base)), NewMem([]byte(c.ours)), NewMem([]byte(c.theirs)))
+		if err != nil {
+			t.Fatalf("TestMerge: %v", err)
+		}
+		if got := string(readAll(merged)); got != c.merged || len(conflicts) != len(c.conflicts) {
+			t.Fatalf("TestMerge: %q, %q, %q gives %q, %v", c.base, c.ours, c.theirs, got, conflicts)
+		}
+		for i := range conflicts {
+			if conflicts[i] != c.conflicts[i] {
+				t.Fatalf("TestMerge: %q, %q, %q: conflict %v, want %v", c.base, c.ours, c.theirs, conflicts[i], c.conflicts[i])
+			}
+		}
+	}
+}
@@ -5,10 +5,23 @@ type node struct {
 	left, right, parent *node
 	data                data
 	size                int64 //left.size + data.size + right.size
+	mem                 int64 //left.mem + bytes of data held in memory + right.mem
 }
 
 func mkNode(d data) *node {
-	return &node{data: d, size: d.Size()}
+	return &node{data: d, size: d.Size(), mem: memsize(d)}
+}
+
+//build a balanced tree out of a list of pieces
+func mkTree(pieces []data) *node {
+	if len(pieces) == 0 {
+		return nil
+	}
+	m := len(pieces) / 2
+	t := mkNode(pieces[m])
+	t.setLeft(mkTree(pieces[:m]))
+	t.setRight(mkTree(pieces[m+1:]))
+	return t
 }
 
 //Copy this node
@@ -51,6 +64,7 @@ func (t *node) setParent(p *node) {
 
 func (t *node) resetSize() {
 	t.size = nodesize(t.left) + t.data.Size() + nodesize(t.right)
+	t.mem = nodemem(t.left) + memsize(t.data) + nodemem(t.right)
 }
 
 //helper function to query t.size, return 0 on t == nil
@@ -61,6 +75,22 @@ func nodesize(t *node) int64 {
 	return 0
 }
 
+//helper function to query t.mem, return 0 on t == nil
+func nodemem(t *node) int64 {
+	if t != nil {
+		return t.mem
+	}
+	return 0
+}
+
+//the number of bytes a piece of data keeps in memory
+func memsize(d data) int64 {
+	if b, ok := d.(*bufData); ok {
+		return b.Size()
+	}
+	return 0
+}
+
 func (n *node) first() *node {
 	for n.left != nil {
 		n = n.left
@@ -115,49 +145,44 @@ func (node *node) get(offset int64) (*node, int64) {
 	}
 }
 
-type stats struct {
-	size                                      int64
-	numnodes, filenodes, datanodes, fixeddata int64
-	maxdist                                   int64   //max distance to root
-	avgdist                                   float64 //avg distance to root
-	maxsz, minsz                              int64   //max/min nodesize
-	avgsz                                     float64 //average nodesize
-}
-
-func updateAvg(avg float64, n_, val_ int64) float64 {
-	n := float64(n_)
-	val := float64(val_)
-	oldsum := avg * n
-	return (oldsum + val) / (n + 1)
-}
-
-func (t *node) stats(st *stats, depth int64) {
+//walk the tree and accumulate piece statistics into st
+//averages and fragmentation are left to the caller (see Buffer.Stats)
+func (t *node) stats(st *Stats, depth int64, depthsum *int64) {
 	if t != nil {
-		t.left.stats(st, depth+1)
-		t.right.stats(st, depth+1)
-		switch t.data.(type) {
+		t.left.stats(st, depth+1, depthsum)
+		t.right.stats(st, depth+1, depthsum)
+		tsz := t.data.Size()
+		switch d := t.data.(type) {
 		case *fileData:
-			st.filenodes++
+			st.FileNodes++
+			st.FileBytes += tsz
 		case *bufData:
-			st.datanodes++
-			if t.data.(*bufData).frozen {
-				st.fixeddata++
+			st.MemNodes++
+			st.MemBytes += tsz
+			if d.frozen {
+				st.FrozenNodes++
 			}
+		case *fillData:
+			st.FillNodes++
+			st.FillBytes += tsz
 		}
-		if depth > st.maxdist {
-			st.maxdist = depth
+		if tsz == 0 {
+			st.EmptyNodes++
+		} else if tsz < maxBufLen {
+			st.SmallNodes++
 		}
-		st.avgdist = updateAvg(st.avgdist, st.numnodes, depth)
-		tsz := t.data.Size()
-		st.avgsz = updateAvg(st.avgsz, st.numnodes, tsz)
-		st.size += tsz
-		if tsz > st.maxsz {
-			st.maxsz = tsz
+		if depth > st.MaxDepth {
+			st.MaxDepth = depth
+		}
+		*depthsum += depth
+		st.Size += tsz
+		if st.Nodes == 0 || tsz < st.MinPieceSize {
+			st.MinPieceSize = tsz
 		}
-		if tsz < st.minsz {
-			st.minsz = tsz
+		if tsz > st.MaxPieceSize {
+			st.MaxPieceSize = tsz
 		}
-		st.numnodes++
+		st.Nodes++
 	}
 }
 
@@ -0,0 +1,300 @@
+//Package ot is operational transformation on documents in filebuf Buffers
+package ot
+
+/* Operational transformation
+   An Operation goes over a whole document, from start to end, and retains,
+   inserts or deletes bytes as it goes (like ot.js does for text). Two
+   operations made on the same document at the same time are transformed
+   against each other, so that applying one and then the other, transformed,
+   gives the same document either way.
+
+   Deletes and retains are counts, so applying an operation to a Buffer only
+   inserts and removes pieces: the retained parts of a big file aren't read.
+   A Server and its Clients keep the copies of a document in sync, see
+   session.go.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/snhmibby/filebuf"
+)
+
+//ErrBadOperation is returned for an operation with an op that isn't exactly one of retain, insert or delete
+var ErrBadOperation = errors.New("ot: bad operation")
+
+//ErrMismatch is returned when an operation doesn't fit a document or another operation
+var ErrMismatch = errors.New("ot: operations don't fit")
+
+//Op is a part of an operation, exactly one of the fields is set
+type Op struct {
+	Retain int64  `json:"retain,omitempty"` //skip this many bytes
+	Insert []byte `json:"insert,omitempty"` //insert these bytes
+	Delete int64  `json:"delete,omitempty"` //delete this many bytes
+}
+
+//the number of bytes op retains, deletes or inserts
+func (op Op) len() int64 {
+	if len(op.Insert) > 0 {
+		return int64(len(op.Insert))
+	}
+	return op.Retain + op.Delete
+}
+
+//Operation is a list of ops that goes over a document from start to end
+//Build one with Retain, Insert and Delete: they merge ops where they can.
+type Operation struct {
+	Ops []Op `json:"ops"`
+}
+
+//Retain adds skipping over the next n bytes to o
+func (o *Operation) Retain(n int64) *Operation {
+	if n <= 0 {
+		return o
+	}
+	if k := len(o.Ops); k > 0 && o.Ops[k-1].Retain > 0 {
+		o.Ops[k-1].Retain += n
+	} else {
+		o.Ops = append(o.Ops, Op{Retain: n})
+	}
+	return o
+}
+
+//Insert adds inserting b to o
+//An insert right after a delete goes before it, so that operations that
+//do the same thing look the same.
+func (o *Operation) Insert(b []byte) *Operation {
+	if len(b) == 0 {
+		return o
+	}
+	k := len(o.Ops)
+	if k > 0 && o.Ops[k-1].Delete > 0 {
+		k--
+	}
+	if k > 0 && len(o.Ops[k-1].Insert) > 0 {
+		o.Ops[k-1].Insert = append(o.Ops[k-1].Insert, b...)
+		return o
+	}
+	o.Ops = append(o.Ops, Op{})
+	copy(o.Ops[k+1:], o.Ops[k:])
+	o.Ops[k] = Op{Insert: append([]byte{}, b...)}
+	return o
+}
+
+//Delete adds deleting the next n bytes to o
+func (o *Operation) Delete(n int64) *Operation {
+	if n <= 0 {
+		return o
+	}
+	if k := len(o.Ops); k > 0 && o.Ops[k-1].Delete > 0 {
+		o.Ops[k-1].Delete += n
+	} else {
+		o.Ops = append(o.Ops, Op{Delete: n})
+	}
+	return o
+}
+
+//add op to o
+func (o *Operation) add(op Op) {
+	switch {
+	case op.Retain > 0:
+		o.Retain(op.Retain)
+	case op.Delete > 0:
+		o.Delete(op.Delete)
+	default:
+		o.Insert(op.Insert)
+	}
+}
+
+//BaseLen returns the size of the documents o applies to
+func (o *Operation) BaseLen() int64 {
+	var n int64
+	for _, op := range o.Ops {
+		n += op.Retain + op.Delete
+	}
+	return n
+}
+
+//TargetLen returns the size of a document after applying o
+func (o *Operation) TargetLen() int64 {
+	var n int64
+	for _, op := range o.Ops {
+		n += op.Retain + int64(len(op.Insert))
+	}
+	return n
+}
+
+//IsNoop returns true if o doesn't change anything
+func (o *Operation) IsNoop() bool {
+	return len(o.Ops) == 0 || (len(o.Ops) == 1 && o.Ops[0].Retain > 0)
+}
+
+//every op is exactly one thing
+func (o *Operation) check() error {
+	for _, op := range o.Ops {
+		set := 0
+		if op.Retain != 0 {
+			set++
+		}
+		if op.Delete != 0 {
+			set++
+		}
+		if len(op.Insert) > 0 {
+			set++
+		}
+		if set != 1 || op.Retain < 0 || op.Delete < 0 {
+			return ErrBadOperation
+		}
+	}
+	return nil
+}
+
+//Apply applies o to fb, which has to be BaseLen bytes
+func (o *Operation) Apply(fb *filebuf.Buffer) error {
+	if err := o.check(); err != nil {
+		return err
+	}
+	if fb.Size() != o.BaseLen() {
+		return fmt.Errorf("%w: operation on %d bytes, document of %d", ErrMismatch, o.BaseLen(), fb.Size())
+	}
+	var pos int64
+	for _, op := range o.Ops {
+		switch {
+		case op.Retain > 0:
+			pos += op.Retain
+		case op.Delete > 0:
+			fb.Remove(pos, op.Delete)
+		default:
+			if err := fb.Insert(pos, op.Insert); err != nil {
+				return err
+			}
+			pos += int64(len(op.Insert))
+		}
+	}
+	return nil
+}
+
+//Compose returns an operation that does what a and then b do
+func Compose(a, b *Operation) (*Operation, error) {
+	if err := a.check(); err != nil {
+		return nil, err
+	}
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	if a.TargetLen() != b.BaseLen() {
+		return nil, fmt.Errorf("%w: compose an operation to %d bytes with one on %d", ErrMismatch, a.TargetLen(), b.BaseLen())
+	}
+	c := &Operation{}
+	i, j := iter(a), iter(b)
+	for i.ok || j.ok {
+		switch {
+		case i.ok && i.cur.Delete > 0:
+			c.add(i.take(i.cur.len()))
+		case j.ok && len(j.cur.Insert) > 0:
+			c.add(j.take(j.cur.len()))
+		default:
+			//what a retained or inserted, b retains or deletes
+			x, y := i.takeBoth(j)
+			switch {
+			case y.Retain > 0:
+				c.add(x)
+			case x.Retain > 0:
+				c.add(y)
+			}
+		}
+	}
+	return c, nil
+}
+
+//Transform returns a1 and b1 such that applying a and then b1 gives the
+//same as applying b and then a1. a and b apply to the same document.
+//Where both insert at the same place, what a inserts goes first.
+func Transform(a, b *Operation) (a1, b1 *Operation, err error) {
+	if err := a.check(); err != nil {
+		return nil, nil, err
+	}
+	if err := b.check(); err != nil {
+		return nil, nil, err
+	}
+	if a.BaseLen() != b.BaseLen() {
+		return nil, nil, fmt.Errorf("%w: transform an operation on %d bytes against one on %d", ErrMismatch, a.BaseLen(), b.BaseLen())
+	}
+	a1, b1 = &Operation{}, &Operation{}
+	i, j := iter(a), iter(b)
+	for i.ok || j.ok {
+		switch {
+		case i.ok && len(i.cur.Insert) > 0:
+			op := i.take(i.cur.len())
+			a1.add(op)
+			b1.Retain(op.len())
+		case j.ok && len(j.cur.Insert) > 0:
+			op := j.take(j.cur.len())
+			a1.Retain(op.len())
+			b1.add(op)
+		default:
+			//both retain or delete the same bytes
+			x, y := i.takeBoth(j)
+			switch {
+			case x.Retain > 0 && y.Retain > 0:
+				a1.add(x)
+				b1.add(y)
+			case x.Delete > 0 && y.Retain > 0:
+				a1.add(x)
+			case x.Retain > 0 && y.Delete > 0:
+				b1.add(y)
+			}
+		}
+	}
+	return a1, b1, nil
+}
+
+//takes the ops of an operation, whole or in part
+type opIter struct {
+	ops []Op
+	cur Op
+	ok  bool //cur is valid
+}
+
+func iter(o *Operation) *opIter {
+	it := &opIter{ops: o.Ops}
+	it.next()
+	return it
+}
+
+func (it *opIter) next() {
+	it.ok = len(it.ops) > 0
+	if it.ok {
+		it.cur, it.ops = it.ops[0], it.ops[1:]
+	}
+}
+
+//take the first n bytes of the current op
+func (it *opIter) take(n int64) Op {
+	op := it.cur
+	if n >= op.len() {
+		it.next()
+		return op
+	}
+	switch {
+	case op.Retain > 0:
+		it.cur.Retain -= n
+		return Op{Retain: n}
+	case op.Delete > 0:
+		it.cur.Delete -= n
+		return Op{Delete: n}
+	}
+	it.cur.Insert = op.Insert[n:]
+	return Op{Insert: op.Insert[:n]}
+}
+
+//take as much of the current ops of it and j as both have
+//The operations have been checked to be of the same length here.
+func (it *opIter) takeBoth(j *opIter) (Op, Op) {
+	n := it.cur.len()
+	if m := j.cur.len(); m < n {
+		n = m
+	}
+	return it.take(n), j.take(n)
+}
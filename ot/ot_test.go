@@ -0,0 +1,200 @@
+package ot
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/snhmibby/filebuf"
+)
+
+func contents(fb *filebuf.Buffer) string {
+	var b bytes.Buffer
+	fb.WriteTo(&b)
+	return b.String()
+}
+
+//a random operation on a document of size bytes
+func randomOperation(rnd *rand.Rand, size int64) *Operation {
+	o := &Operation{}
+	for size > 0 {
+		n := rnd.Int63n(size) + 1
+		switch rnd.Intn(3) {
+		case 0:
+			o.Retain(n)
+			size -= n
+		case 1:
+			o.Delete(n)
+			size -= n
+		case 2:
+			o.Insert([]byte("abcdefghij"[:rnd.Intn(10)+1]))
+		}
+	}
+	if rnd.Intn(2) == 0 {
+		o.Insert([]byte("XYZ"))
+	}
+	return o
+}
+
+func apply(t *testing.T, doc string, ops ...*Operation) string {
+	fb := filebuf.NewMem([]byte(doc))
+	for _, o := range ops {
+		if err := o.Apply(fb); err != nil {
+			t.Fatalf("apply %v on %q: %v", o, doc, err)
+		}
+	}
+	return contents(fb)
+}
+
+func TestOperation(t *testing.T) {
+	o := (&Operation{}).Retain(2).Delete(3).Insert([]byte("ab")).Insert([]byte("c")).Retain(1)
+	want := []Op{{Retain: 2}, {Insert: []byte("abc")}, {Delete: 3}, {Retain: 1}}
+	if len(o.Ops) != len(want) {
+		t.Fatalf("TestOperation: %v", o.Ops)
+	}
+	for i := range want {
+		if o.Ops[i].Retain != want[i].Retain || o.Ops[i].Delete != want[i].Delete || !bytes.Equal(o.Ops[i].Insert, want[i].Insert) {
+			t.Fatalf("TestOperation: %v", o.Ops)
+		}
+	}
+	if o.BaseLen() != 6 || o.TargetLen() != 6 {
+		t.Fatalf("TestOperation: base %d, target %d", o.BaseLen(), o.TargetLen())
+	}
+	if got := apply(t, "012345", o); got != "01abc5" {
+		t.Fatalf("TestOperation: gives %q", got)
+	}
+	if err := o.Apply(filebuf.NewMem([]byte("0123"))); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("TestOperation: on a short document: %v", err)
+	}
+	bad := &Operation{Ops: []Op{{Retain: 1, Delete: 1}}}
+	if err := bad.Apply(filebuf.NewMem([]byte("01"))); !errors.Is(err, ErrBadOperation) {
+		t.Fatalf("TestOperation: bad op: %v", err)
+	}
+}
+
+func TestTransformCompose(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		doc := make([]byte, rnd.Intn(30))
+		for j := range doc {
+			doc[j] = byte('0' + rnd.Intn(10))
+		}
+		a := randomOperation(rnd, int64(len(doc)))
+		b := randomOperation(rnd, int64(len(doc)))
+		a1, b1, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("TestTransform: %v", err)
+		}
+		if x, y := apply(t, string(doc), a, b1), apply(t, string(doc), b, a1); x != y {
+			t.Fatalf("TestTransform: %q: %v, %v gives %q and %q", doc, a, b, x, y)
+		}
+
+		c := randomOperation(rnd, a.TargetLen())
+		ac, err := Compose(a, c)
+		if err != nil {
+			t.Fatalf("TestCompose: %v", err)
+		}
+		if x, y := apply(t, string(doc), a, c), apply(t, string(doc), ac); x != y {
+			t.Fatalf("TestCompose: %q: %v, %v gives %q and %q", doc, a, c, x, y)
+		}
+	}
+	if _, _, err := Transform((&Operation{}).Retain(1), (&Operation{}).Retain(2)); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("TestTransform: different bases: %v", err)
+	}
+}
+
+//a message from or to the server
+type message struct {
+	rev int
+	op  *Operation
+	ack bool
+}
+
+func TestSession(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	start := "the quick brown fox jumps over the lazy dog"
+	server := NewServer(filebuf.NewMem([]byte(start)))
+
+	const nclients = 3
+	var clients [nclients]*Client
+	var docs [nclients]*filebuf.Buffer
+	var toServer, toClient [nclients][]message
+	for i := range clients {
+		i := i
+		docs[i] = filebuf.NewMem([]byte(start))
+		clients[i] = NewClient(docs[i], 0, func(rev int, op *Operation) {
+			toServer[i] = append(toServer[i], message{rev: rev, op: op})
+		})
+	}
+
+	//the server handles one message of client i
+	serve := func(i int) {
+		m := toServer[i][0]
+		toServer[i] = toServer[i][1:]
+		op, err := server.Receive(m.rev, m.op)
+		if err != nil {
+			t.Fatalf("TestSession: server: %v", err)
+		}
+		for j := range clients {
+			toClient[j] = append(toClient[j], message{op: op, ack: i == j})
+		}
+	}
+	//client i handles one message of the server
+	deliver := func(i int) {
+		m := toClient[i][0]
+		toClient[i] = toClient[i][1:]
+		var err error
+		if m.ack {
+			err = clients[i].Ack()
+		} else {
+			err = clients[i].Receive(m.op)
+		}
+		if err != nil {
+			t.Fatalf("TestSession: client %d: %v", i, err)
+		}
+	}
+
+	for step := 0; step < 2000; step++ {
+		i := rnd.Intn(nclients)
+		switch rnd.Intn(3) {
+		case 0:
+			if err := clients[i].Edit(randomOperation(rnd, docs[i].Size())); err != nil {
+				t.Fatalf("TestSession: edit: %v", err)
+			}
+		case 1:
+			if len(toServer[i]) > 0 {
+				serve(i)
+			}
+		case 2:
+			if len(toClient[i]) > 0 {
+				deliver(i)
+			}
+		}
+	}
+	//let everything arrive
+	for busy := true; busy; {
+		busy = false
+		for i := range clients {
+			for len(toServer[i]) > 0 || len(toClient[i]) > 0 {
+				busy = true
+				if len(toServer[i]) > 0 {
+					serve(i)
+				}
+				if len(toClient[i]) > 0 {
+					deliver(i)
+				}
+			}
+		}
+	}
+
+	want := contents(server.doc)
+	for i := range clients {
+		if got := contents(docs[i]); got != want {
+			t.Fatalf("TestSession: client %d has %q, server %q", i, got, want)
+		}
+		if clients[i].Revision() != server.Revision() {
+			t.Fatalf("TestSession: client %d at revision %d, server at %d", i, clients[i].Revision(), server.Revision())
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package ot
+
+/* Sessions
+   The server decides the order of the operations. It keeps the history of
+   the operations it applied, and a client sends along the revision (the
+   length of the history) its operation was made on. The server transforms
+   it against everything that happened since, applies it and sends it to
+   everybody: to the client that sent it as an acknowledgement, to the others
+   as an operation to apply.
+
+   A client has at most one operation out at the server. Edits made while
+   waiting for the acknowledgement are composed into one operation that is
+   sent when it comes in. Operations from the server are transformed against
+   the ones the server didn't apply yet, as the server will transform those
+   against it. How the messages travel is up to the user: a Client calls a
+   function to send, the user calls Ack and Receive when messages arrive.
+*/
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/snhmibby/filebuf"
+)
+
+//Server holds the document and the history of operations applied to it
+type Server struct {
+	lock    sync.Mutex
+	doc     *filebuf.Buffer
+	history []*Operation
+}
+
+//NewServer starts a session on doc, at revision 0
+//While the session runs, doc should only be changed by the server.
+func NewServer(doc *filebuf.Buffer) *Server {
+	return &Server{doc: doc}
+}
+
+//Revision returns the number of operations the server applied
+func (s *Server) Revision() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.history)
+}
+
+//Receive applies op, made by a client on revision rev of the document
+//It returns op as the server applied it, to send to all clients: the one
+//that sent it takes it as an acknowledgement.
+func (s *Server) Receive(rev int, op *Operation) (*Operation, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rev < 0 || rev > len(s.history) {
+		return nil, fmt.Errorf("%w: operation on revision %d, server is at %d", ErrMismatch, rev, len(s.history))
+	}
+	for _, h := range s.history[rev:] {
+		var err error
+		if op, _, err = Transform(op, h); err != nil {
+			return nil, err
+		}
+	}
+	if err := op.Apply(s.doc); err != nil {
+		return nil, err
+	}
+	s.history = append(s.history, op)
+	return op, nil
+}
+
+//Client holds a copy of the document and what the server doesn't know yet
+type Client struct {
+	lock        sync.Mutex
+	doc         *filebuf.Buffer
+	rev         int
+	outstanding *Operation //sent, not acknowledged
+	waiting     *Operation //edits while waiting for the acknowledgement
+	send        func(rev int, op *Operation)
+}
+
+//NewClient joins a session with doc, which is revision rev of the document
+//send is called with every operation for the server, it shouldn't call back
+//into the client.
+func NewClient(doc *filebuf.Buffer, rev int, send func(rev int, op *Operation)) *Client {
+	return &Client{doc: doc, rev: rev, send: send}
+}
+
+//Revision returns the revision the client is at
+func (c *Client) Revision() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rev
+}
+
+//Edit applies op, an edit of the user, to the document and sends it
+func (c *Client) Edit(op *Operation) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := op.Apply(c.doc); err != nil {
+		return err
+	}
+	switch {
+	case c.outstanding == nil:
+		c.outstanding = op
+		c.send(c.rev, op)
+	case c.waiting == nil:
+		c.waiting = op
+	default:
+		w, err := Compose(c.waiting, op)
+		if err != nil {
+			return err
+		}
+		c.waiting = w
+	}
+	return nil
+}
+
+//Ack is called when the server acknowledges the operation the client sent
+func (c *Client) Ack() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.outstanding == nil {
+		return fmt.Errorf("%w: acknowledgement without an operation", ErrMismatch)
+	}
+	c.rev++
+	c.outstanding, c.waiting = c.waiting, nil
+	if c.outstanding != nil {
+		c.send(c.rev, c.outstanding)
+	}
+	return nil
+}
+
+//Receive applies op, an operation of another client, as sent by the server
+func (c *Client) Receive(op *Operation) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var err error
+	out, waiting := c.outstanding, c.waiting
+	if out != nil {
+		if out, op, err = Transform(out, op); err != nil {
+			return err
+		}
+	}
+	if waiting != nil {
+		if waiting, op, err = Transform(waiting, op); err != nil {
+			return err
+		}
+	}
+	if err = op.Apply(c.doc); err != nil {
+		return err
+	}
+	c.outstanding, c.waiting = out, waiting
+	c.rev++
+	return nil
+}
@@ -0,0 +1,223 @@
+package filebuf
+
+/* Binary patches
+   A patch is applied by building the patched contents as a new tree out of
+   pieces of the original (copies), new bytes and fills, see builder.
+   That tree is then diffed against the original and the differences are
+   applied as edits, so the journal sees normal edits and everything the
+   patch didn't touch stays as it was: pieces of the original file.
+
+   Patches are made from a Diff, so they don't find data that moved around.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//PatchFormat is a binary patch format
+type PatchFormat int
+
+const (
+	VCDIFF PatchFormat = iota + 1 //RFC 3284 (xdelta3, open-vcdiff), without secondary compression
+	BSDiff                        //BSDIFF40, as made by bsdiff 4
+	IPS                           //International Patching System, overwrites, files up to 16MB
+	UPS                           //UPS1, xor's with crc32 checks, can be applied in reverse
+	BPS                           //BPS1 (beat), copies and new bytes with crc32 checks
+)
+
+func (f PatchFormat) String() string {
+	switch f {
+	case VCDIFF:
+		return "VCDIFF"
+	case BSDiff:
+		return "bsdiff"
+	case IPS:
+		return "IPS"
+	case UPS:
+		return "UPS"
+	case BPS:
+		return "BPS"
+	}
+	return "unknown patch format"
+}
+
+//ErrBadPatch is wrapped by the errors about malformed patches
+var ErrBadPatch = errors.New("filebuf: bad patch")
+
+//copies smaller than this are made from bytes, not pieces
+const smallCopy = 64
+
+//ApplyPatch applies the patch read from r to fb
+//Nothing is changed if the patch can't be applied.
+func (fb *Buffer) ApplyPatch(r io.Reader, format PatchFormat) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	orig := &Buffer{root: fb.root.Copy()}
+	var result *Buffer
+	var err error
+	switch format {
+	case VCDIFF:
+		result, err = applyVCDIFF(orig, r)
+	case BSDiff:
+		result, err = applyBSDiff(orig, r)
+	case IPS:
+		result, err = applyIPS(orig, r)
+	case UPS:
+		result, err = applyUPS(orig, r)
+	case BPS:
+		result, err = applyBPS(orig, r)
+	default:
+		err = fmt.Errorf("filebuf: can't apply patches in format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+	return fb.replaceWith(orig, result)
+}
+
+//MakePatch returns a patch that turns old into new
+func MakePatch(old, new *Buffer, format PatchFormat) ([]byte, error) {
+	old, new = old.snapshot(), new.snapshot()
+	//these only overwrite, they don't need a diff
+	switch format {
+	case IPS:
+		return makeIPS(old, new)
+	case UPS:
+		return makeUPS(old, new)
+	}
+	steps, err := diff(old, new)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case VCDIFF:
+		return makeVCDIFF(old, new, steps)
+	case BSDiff:
+		return makeBSDiff(old, new, steps)
+	case BPS:
+		return makeBPS(old, new, steps)
+	}
+	return nil, fmt.Errorf("filebuf: can't make patches in format %v", format)
+}
+
+//edit fb (with contents orig) until it holds the contents of result
+func (fb *Buffer) replaceWith(orig, result *Buffer) error {
+	steps, err := diff(orig, result)
+	if err != nil {
+		return err
+	}
+	//back to front, so the offsets in orig stay right
+	for i := len(steps) - 1; i >= 0; i-- {
+		switch st := steps[i]; st.Op {
+		case DiffDelete:
+			fb.remove(st.A, st.Size)
+		case DiffInsert:
+			fb.paste(st.A, result.copy(st.B, st.Size))
+		}
+	}
+	return nil
+}
+
+//builds a buffer by appending to it
+type builder struct {
+	out *Buffer
+}
+
+func mkBuilder() *builder {
+	return &builder{out: NewEmpty()}
+}
+
+func (b *builder) size() int64 {
+	return b.out.size()
+}
+
+func (b *builder) add(p []byte) {
+	if len(p) > 0 {
+		b.out.insert(b.out.size(), p)
+	}
+}
+
+func (b *builder) fill(pattern []byte, n int64) {
+	b.out.insertFill(b.out.size(), pattern, n)
+}
+
+//append n bytes of src at off, src can be b.out itself
+func (b *builder) copy(src *Buffer, off, n int64) error {
+	if off < 0 || n < 0 || off+n > src.size() {
+		return fmt.Errorf("%w: copy of [%d, %d) from %d bytes", ErrBadPatch, off, off+n, src.size())
+	}
+	if n < smallCopy {
+		p, err := src.bytes(off, n)
+		b.add(p)
+		return err
+	}
+	b.out.paste(b.out.size(), src.copy(off, n))
+	return nil
+}
+
+//append n bytes of b.out starting at off, they may overlap with what's being appended
+func (b *builder) copySelf(off, n int64) error {
+	period := b.size() - off
+	if off < 0 || period <= 0 {
+		return fmt.Errorf("%w: copy from %d in a target of %d bytes", ErrBadPatch, off, b.size())
+	}
+	if n <= period {
+		return b.copy(b.out, off, n)
+	}
+	//overlapping: the last period bytes repeat
+	p, err := b.out.bytes(off, period)
+	if err != nil {
+		return err
+	}
+	b.fill(p, n)
+	return nil
+}
+
+//readers for patch formats
+
+//read a byte or fail with ErrBadPatch
+func patchByte(r io.ByteReader) (byte, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadPatch, err)
+	}
+	return c, nil
+}
+
+//read n bytes or fail with ErrBadPatch
+func patchBytes(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("%w: negative length", ErrBadPatch)
+	}
+	p := make([]byte, 0, minInt64(n, 1<<20))
+	buf := make([]byte, minInt64(n, 64*1024))
+	for int64(len(p)) < n {
+		m, err := io.ReadFull(r, buf[:minInt64(int64(len(buf)), n-int64(len(p)))])
+		p = append(p, buf[:m]...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadPatch, err)
+		}
+	}
+	return p, nil
+}
+
+//where the first run of at least min equal bytes in p starts, or len(p)
+func runStart(p []byte, min int) int {
+	for i, r := 1, 1; i < len(p); i++ {
+		if p[i] != p[i-1] {
+			r = 1
+		} else if r++; r == min {
+			return i - min + 1
+		}
+	}
+	return len(p)
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
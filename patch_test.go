@@ -0,0 +1,177 @@
+package filebuf
+
+import (
+	"bytes"
+	"errors"
+	"hash/adler32"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	src := make([]byte, 1<<20)
+	rnd.Read(src)
+	for _, format := range []PatchFormat{VCDIFF, BSDiff} {
+		old, err := OpenFile(tempFile(t, src))
+		if err != nil {
+			t.Fatalf("TestPatch: %v", err)
+		}
+		defer old.Close()
+		new := old.Copy(0, old.Size())
+		new.Insert(1000, helloworld)
+		new.Remove(50000, 100)
+		new.Paste(new.Size(), old.Copy(200000, 1000))
+		new.InsertFill(300000, []byte{0}, 5000)
+		new.Remove(600000, new.Size()-700000)
+		want := readAll(new)
+
+		patch, err := MakePatch(old, new, format)
+		if err != nil {
+			t.Fatalf("TestPatch %v: %v", format, err)
+		}
+		if len(patch) > 4000 {
+			t.Errorf("TestPatch %v: patch of %d bytes", format, len(patch))
+		}
+		if err := old.ApplyPatch(bytes.NewReader(patch), format); err != nil {
+			t.Fatalf("TestPatch %v: %v", format, err)
+		}
+		if !bytes.Equal(readAll(old), want) {
+			t.Fatalf("TestPatch %v: patched buffer is wrong", format)
+		}
+		if st := old.Stats(); st.FileBytes < st.Size-10000 {
+			t.Errorf("TestPatch %v: only %d of %d bytes are pieces of the file", format, st.FileBytes, st.Size)
+		}
+
+		//a broken patch changes nothing
+		if err := old.ApplyPatch(bytes.NewReader(patch[:len(patch)/2]), format); !errors.Is(err, ErrBadPatch) {
+			t.Errorf("TestPatch %v: broken patch gives %v", format, err)
+		}
+		if !bytes.Equal(readAll(old), want) {
+			t.Fatalf("TestPatch %v: broken patch changed the buffer", format)
+		}
+	}
+
+	//from and to empty buffers
+	for _, format := range []PatchFormat{VCDIFF, BSDiff} {
+		for _, c := range [][2][]byte{{nil, helloworld}, {helloworld, nil}, {nil, nil}} {
+			old, new := NewMem(c[0]), NewMem(c[1])
+			patch, err := MakePatch(old, new, format)
+			if err == nil {
+				err = old.ApplyPatch(bytes.NewReader(patch), format)
+			}
+			if err != nil || !bytes.Equal(readAll(old), c[1]) {
+				t.Errorf("TestPatch %v: %q to %q: %q, %v", format, c[0], c[1], readAll(old), err)
+			}
+		}
+	}
+}
+
+//a VCDIFF with what MakePatch doesn't use: RUN, HERE and near addresses,
+//overlapping copies, target windows, checksums and an application header
+func TestVCDIFF(t *testing.T) {
+	want := []byte("abcdxyzzzzzxyzzzzzxyzxyzzabcd")
+	window := func(ind byte, srcLen int64, tgt []byte, data, inst, addr []byte) []byte {
+		var delta []byte
+		delta = appendVcdInt(delta, int64(len(tgt)))
+		delta = append(delta, 0)
+		delta = appendVcdInt(delta, int64(len(data)))
+		delta = appendVcdInt(delta, int64(len(inst)))
+		delta = appendVcdInt(delta, int64(len(addr)))
+		sum := adler32.Checksum(tgt)
+		delta = append(delta, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+		delta = append(append(append(delta, data...), inst...), addr...)
+		w := appendVcdInt(appendVcdInt([]byte{ind | vcdChecksum}, srcLen), 0)
+		return append(appendVcdInt(w, int64(len(delta))), delta...)
+	}
+	patch := append(append([]byte{}, vcdMagic...), vcdAppHeader, 3, 'a', 'p', 'p')
+	//COPY 4 SELF 0, ADD "xy", RUN 5 'z', COPY 10 HERE 7 (overlapping), COPY 4 near[1]
+	patch = append(patch, window(vcdSource, 8, want[:25], []byte("xyz"), []byte{20, 3, 0, 5, 42, 68}, []byte{0, 7, 0})...)
+	//COPY 4 SELF 0 from the target
+	patch = append(patch, window(vcdTarget, 4, want[25:], nil, []byte{20}, []byte{0})...)
+
+	fb := NewMem([]byte("abcdefgh"))
+	if err := fb.ApplyPatch(bytes.NewReader(patch), VCDIFF); err != nil {
+		t.Fatalf("TestVCDIFF: %v", err)
+	}
+	if got := readAll(fb); !bytes.Equal(got, want) {
+		t.Fatalf("TestVCDIFF: got %q, want %q", got, want)
+	}
+
+	patch[len(patch)-1] = 1
+	if err := fb.ApplyPatch(bytes.NewReader(patch), VCDIFF); !errors.Is(err, ErrBadPatch) {
+		t.Fatalf("TestVCDIFF: bad checksum gives %v", err)
+	}
+}
+
+func TestROMPatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	rom := make([]byte, 300000)
+	rnd.Read(rom)
+	edits := []func(b *Buffer){
+		func(b *Buffer) { b.Seek(1000, io.SeekStart); b.Write(helloworld) },
+		func(b *Buffer) { b.Fill(5000, 70000, []byte{0xff}) },
+		func(b *Buffer) { b.Resize(b.Size()+1000, 0) },
+		func(b *Buffer) { b.Seek(b.Size()+10, io.SeekStart); b.Write(helloworld) },
+		func(b *Buffer) { b.Truncate(200000) },
+		func(b *Buffer) { b.Insert(100, helloworld) },
+	}
+	for _, format := range []PatchFormat{IPS, UPS, BPS} {
+		for i, edit := range edits {
+			old := NewMem(rom)
+			new := old.Copy(0, old.Size())
+			edit(new)
+			want := readAll(new)
+			patch, err := MakePatch(old, new, format)
+			if err == nil {
+				err = old.ApplyPatch(bytes.NewReader(patch), format)
+			}
+			if err != nil {
+				t.Fatalf("TestROMPatch %v, edit %d: %v", format, i, err)
+			}
+			if !bytes.Equal(readAll(old), want) {
+				t.Fatalf("TestROMPatch %v, edit %d: patched buffer is wrong", format, i)
+			}
+			if format == UPS {
+				//backwards
+				if err := old.ApplyPatch(bytes.NewReader(patch), format); err != nil || !bytes.Equal(readAll(old), rom) {
+					t.Fatalf("TestROMPatch: UPS edit %d doesn't undo: %v", i, err)
+				}
+			}
+		}
+
+		//checksums
+		if format != IPS {
+			patch, _ := MakePatch(NewMem(rom), NewMem(helloworld), format)
+			if err := NewMem(testdata).ApplyPatch(bytes.NewReader(patch), format); !errors.Is(err, ErrBadPatch) {
+				t.Errorf("TestROMPatch %v: patch for another file gives %v", format, err)
+			}
+			patch[len(patch)-20] ^= 1
+			if err := NewMem(rom).ApplyPatch(bytes.NewReader(patch), format); !errors.Is(err, ErrBadPatch) {
+				t.Errorf("TestROMPatch %v: corrupted patch gives %v", format, err)
+			}
+		}
+	}
+
+	//a record can't start at 0x454f46, the offset that reads as "EOF"
+	old := NewEmpty()
+	old.InsertFill(0, []byte{0}, ipsEOF+100)
+	new := old.Copy(0, old.Size())
+	new.Fill(ipsEOF, 1, []byte{1})
+	new.Fill(ipsEOF+20, 20, []byte{2})
+	patch, err := MakePatch(old, new, IPS)
+	if err == nil {
+		err = old.ApplyPatch(bytes.NewReader(patch), IPS)
+	}
+	if err != nil || !bytes.Equal(readAll(old), readAll(new)) {
+		t.Fatalf("TestROMPatch: IPS record at EOF: %v", err)
+	}
+
+	//a hand made IPS: a record, an RLE record and truncation
+	ips := []byte("PATCH\x00\x00\x02\x00\x02xy\x00\x00\x06\x00\x00\x00\x03zEOF\x00\x00\x08")
+	fb := NewMem([]byte("abcdefghij"))
+	if err := fb.ApplyPatch(bytes.NewReader(ips), IPS); err != nil || string(readAll(fb)) != "abxyefzz" {
+		t.Fatalf("TestROMPatch: IPS gives %q, %v", readAll(fb), err)
+	}
+}
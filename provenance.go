@@ -0,0 +1,177 @@
+package filebuf
+
+/* Provenance
+   Where do the bytes of a buffer come from? A file piece that refers to the
+   original at the offset it is at now is unmodified. The original is what
+   the buffer was opened from: its backing files, one after the other, or
+   for NewFromReaderAt and NewFromReader the reader. Holes of a sparse
+   original count as file pieces. Memory and other fill pieces are inserted,
+   and so are file pieces of other files and of the scratch file.
+   The same walk over the pieces maps offsets between the original and fb.
+*/
+
+import (
+	"fmt"
+	"io"
+)
+
+//Origin says where a range of a buffer comes from
+type Origin int
+
+const (
+	Original Origin = iota //the bytes at this offset in the original
+	Moved                  //bytes of the original, from another offset
+	Inserted               //bytes that aren't from the original
+)
+
+func (o Origin) String() string {
+	switch o {
+	case Original:
+		return "original"
+	case Moved:
+		return "moved"
+	case Inserted:
+		return "inserted"
+	}
+	return fmt.Sprintf("Origin(%d)", int(o))
+}
+
+//Provenance is a range of a buffer and where it comes from
+type Provenance struct {
+	Offset, Size int64
+	Origin       Origin
+	From         int64 //offset in the original, for Original and Moved
+}
+
+//ModifiedRanges returns the ranges of fb that are not what the original has
+//at those offsets, in order. Adjacent pieces with the same origin are merged.
+//What was deleted doesn't show up, see MapOriginalToCurrent for that.
+func (fb *Buffer) ModifiedRanges() []Provenance {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	var out []Provenance
+	fb.provenance(0, fb.size(), func(p Provenance) {
+		if p.Origin != Original {
+			out = append(out, p)
+		}
+	})
+	return out
+}
+
+//IsOriginal returns true if the byte at off is the byte the original has there
+func (fb *Buffer) IsOriginal(off int64) bool {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	orig := false
+	fb.provenance(off, off+1, func(p Provenance) {
+		orig = p.Origin == Original
+	})
+	return orig
+}
+
+//MapCurrentToOriginal returns the offset in the original of the byte at off,
+//false if it is not from the original (it was inserted, or off is out of range)
+func (fb *Buffer) MapCurrentToOriginal(off int64) (int64, bool) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	var from int64
+	ok := false
+	fb.provenance(off, off+1, func(p Provenance) {
+		from, ok = p.From, p.Origin != Inserted
+	})
+	return from, ok
+}
+
+//MapOriginalToCurrent returns where the byte at off in the original is now
+//If it is in fb more than once (it was copied), the first one is returned.
+//If it was deleted, it returns false and the offset where it would be:
+//right after the closest byte of the original before it that is still in fb
+//(the first of those, if that one is in there more than once), or 0.
+func (fb *Buffer) MapOriginalToCurrent(off int64) (int64, bool) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	var cur, before int64
+	found := false
+	closest := int64(-1) //end in the original of the closest range before off
+	fb.provenance(0, fb.size(), func(p Provenance) {
+		switch {
+		case found || p.Origin == Inserted:
+		case p.From <= off && off < p.From+p.Size:
+			cur, found = p.Offset+off-p.From, true
+		case p.From+p.Size <= off && p.From+p.Size > closest:
+			closest, before = p.From+p.Size, p.Offset+p.Size
+		}
+	})
+	if found {
+		return cur, true
+	}
+	return before, false
+}
+
+//call cb with the provenance of [start, end), merged where possible
+func (fb *Buffer) provenance(start, end int64, cb func(Provenance)) {
+	if start < 0 {
+		start = 0
+	}
+	if end > fb.size() {
+		end = fb.size()
+	}
+	o := fb.origins()
+	var cur Provenance
+	pos := start
+	fb.pieces(start, end, func(d data, off, size int64) bool {
+		p := Provenance{Offset: pos, Size: size, Origin: Inserted}
+		if from, ok := o.of(d, off); ok {
+			p.From = from
+			if p.Origin = Moved; from == pos {
+				p.Origin = Original
+			}
+		}
+		pos += size
+		contiguous := p.Origin == Inserted || cur.From+cur.Size == p.From
+		if cur.Size > 0 && cur.Origin == p.Origin && contiguous {
+			cur.Size += p.Size
+			return false
+		}
+		if cur.Size > 0 {
+			cb(cur)
+		}
+		cur = p
+		return false
+	})
+	if cur.Size > 0 {
+		cb(cur)
+	}
+}
+
+//the files of the original and where they start in it
+//A buffer without an original has none, all of it is inserted.
+type origins struct {
+	base map[io.ReaderAt]int64
+}
+
+func (fb *Buffer) origins() *origins {
+	o := &origins{base: make(map[io.ReaderAt]int64)}
+	var base int64
+	for _, b := range fb.backing {
+		o.base[b.file] = base
+		base += b.length
+	}
+	if fb.source != nil {
+		o.base[fb.source] = 0
+	}
+	return o
+}
+
+//the offset in the original of byte off of d, false if it's not from the original
+func (o *origins) of(d data, off int64) (int64, bool) {
+	file, at, ok := fileSource(d)
+	if !ok {
+		return 0, false
+	}
+	base, ok := o.base[file]
+	if !ok {
+		return 0, false
+	}
+	return base + at + off, true
+}
@@ -0,0 +1,490 @@
+package filebuf
+
+/* ROM patches: IPS, UPS and BPS
+   IPS and UPS overwrite bytes at fixed offsets, they are applied by
+   overwriting a copy of the buffer. BPS is like VCDIFF, reads from the
+   source, the target so far and new bytes, it uses the builder.
+   UPS and BPS end with the crc32's of the source, the target and the patch,
+   all of them are checked.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	ipsEOF     = 0x454f46   //"EOF", records can't start here
+	ipsMaxSize = 1<<24 - 1  //the truncation extension can't say 1<<24
+	ipsMaxRec  = 0xffff - 1 //leave room to move a record off ipsEOF
+	ipsMinRun  = 9          //shortest run that becomes an RLE record
+)
+
+var (
+	ipsMagic = []byte("PATCH")
+	upsMagic = []byte("UPS1")
+	bpsMagic = []byte("BPS1")
+)
+
+//BPS commands
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+func applyIPS(orig *Buffer, r io.Reader) (*Buffer, error) {
+	br := bufio.NewReader(r)
+	magic, err := patchBytes(br, int64(len(ipsMagic)))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, ipsMagic) {
+		return nil, fmt.Errorf("%w: not an IPS patch", ErrBadPatch)
+	}
+	out := &Buffer{root: orig.root.Copy()}
+	for {
+		hdr, err := patchBytes(br, 3)
+		if err != nil {
+			return nil, err
+		}
+		if string(hdr) == "EOF" {
+			//the truncation extension: the new size follows
+			if t, err := patchBytes(br, 3); err == nil {
+				if size := int64(t[0])<<16 | int64(t[1])<<8 | int64(t[2]); size < out.size() {
+					out.remove(size, out.size()-size)
+				}
+			}
+			return out, nil
+		}
+		sz, err := patchBytes(br, 2)
+		if err != nil {
+			return nil, err
+		}
+		off := int64(hdr[0])<<16 | int64(hdr[1])<<8 | int64(hdr[2])
+		n := int64(sz[0])<<8 | int64(sz[1])
+		if n > 0 {
+			var p []byte
+			if p, err = patchBytes(br, n); err == nil {
+				err = out.writeAt(p, off)
+			}
+		} else {
+			var rle []byte
+			if rle, err = patchBytes(br, 3); err == nil {
+				if off > out.size() {
+					err = out.resize("ApplyPatch", off, 0)
+				}
+				if err == nil {
+					err = out.fill(off, int64(rle[0])<<8|int64(rle[1]), rle[2:])
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func makeIPS(old, new *Buffer) ([]byte, error) {
+	if new.size() > ipsMaxSize {
+		return nil, fmt.Errorf("filebuf: %d bytes is too big for an IPS patch", new.size())
+	}
+	w := &ipsWriter{out: append([]byte{}, ipsMagic...), new: new}
+	end := int64(0)
+	err := changedRuns(old, new, func(off int64, _, y []byte) error {
+		if off >= new.size() {
+			return nil
+		}
+		if off+int64(len(y)) > new.size() {
+			y = y[:new.size()-off]
+		}
+		end = off + int64(len(y))
+		return w.write(off, y)
+	})
+	if err != nil {
+		return nil, err
+	}
+	//growing with zeroes: they don't differ from the zeroes past the end of old
+	if new.size() > old.size() && end < new.size() {
+		if err := w.write(new.size()-1, []byte{0}); err != nil {
+			return nil, err
+		}
+	}
+	w.out = append(w.out, "EOF"...)
+	if new.size() < old.size() {
+		w.out = append(w.out, byte(new.size()>>16), byte(new.size()>>8), byte(new.size()))
+	}
+	return w.out, nil
+}
+
+type ipsWriter struct {
+	out []byte
+	new *Buffer
+}
+
+//write records that put p at off
+func (w *ipsWriter) write(off int64, p []byte) error {
+	for len(p) > 0 {
+		run := 1
+		for run < len(p) && run < ipsMaxRec && p[run] == p[0] {
+			run++
+		}
+		var err error
+		if run >= ipsMinRun {
+			err = w.rle(off, p[0], run)
+		} else {
+			if run = runStart(p, ipsMinRun); run > ipsMaxRec {
+				run = ipsMaxRec
+			}
+			err = w.record(off, p[:run])
+		}
+		if err != nil {
+			return err
+		}
+		off += int64(run)
+		p = p[run:]
+	}
+	return nil
+}
+
+func (w *ipsWriter) record(off int64, p []byte) error {
+	if off == ipsEOF {
+		//start a byte earlier, writing it again
+		b, err := w.new.bytes(off-1, 1)
+		if err != nil {
+			return err
+		}
+		off, p = off-1, append(b, p...)
+	}
+	w.out = append(w.out, byte(off>>16), byte(off>>8), byte(off), byte(len(p)>>8), byte(len(p)))
+	w.out = append(w.out, p...)
+	return nil
+}
+
+func (w *ipsWriter) rle(off int64, c byte, n int) error {
+	if off == ipsEOF {
+		if err := w.record(off, []byte{c}); err != nil {
+			return err
+		}
+		off, n = off+1, n-1
+	}
+	w.out = append(w.out, byte(off>>16), byte(off>>8), byte(off), 0, 0, byte(n>>8), byte(n), c)
+	return nil
+}
+
+func applyUPS(orig *Buffer, r io.Reader) (*Buffer, error) {
+	body, crcs, err := readROMPatch(r, upsMagic)
+	if err != nil {
+		return nil, err
+	}
+	inSize, err := romInt(body)
+	if err != nil {
+		return nil, err
+	}
+	outSize, err := romInt(body)
+	if err != nil {
+		return nil, err
+	}
+	inCRC, outCRC := crcs[0], crcs[1]
+	crc, err := orig.CRC32(0, orig.size())
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case orig.size() == inSize && crc == inCRC:
+	case orig.size() == outSize && crc == outCRC:
+		//xor's work both ways, undo the patch
+		inSize, outSize, inCRC, outCRC = outSize, inSize, outCRC, inCRC
+	default:
+		return nil, fmt.Errorf("%w: the UPS patch is for a different file", ErrBadPatch)
+	}
+
+	out := &Buffer{root: orig.root.Copy()}
+	size := inSize
+	if outSize > size {
+		size = outSize
+	}
+	out.resize("ApplyPatch", size, 0)
+	var pos int64
+	for body.Len() > 0 {
+		skip, err := romInt(body)
+		if err != nil {
+			return nil, err
+		}
+		pos += skip
+		var x []byte
+		for {
+			c, err := patchByte(body)
+			if err != nil {
+				return nil, err
+			}
+			if c == 0 {
+				break
+			}
+			x = append(x, c)
+		}
+		if pos < 0 || pos+int64(len(x)) > size {
+			return nil, fmt.Errorf("%w: UPS record at %d past the end", ErrBadPatch, pos)
+		}
+		p, err := out.bytes(pos, int64(len(x)))
+		if err != nil {
+			return nil, err
+		}
+		for i := range p {
+			p[i] ^= x[i]
+		}
+		if err := out.writeAt(p, pos); err != nil {
+			return nil, err
+		}
+		pos += int64(len(x)) + 1
+	}
+	out.resize("ApplyPatch", outSize, 0)
+	return out, checkROMResult(out, outCRC)
+}
+
+func makeUPS(old, new *Buffer) ([]byte, error) {
+	out := append([]byte{}, upsMagic...)
+	out = appendROMInt(out, old.size())
+	out = appendROMInt(out, new.size())
+	var pos int64
+	err := changedRuns(old, new, func(off int64, x, y []byte) error {
+		out = appendROMInt(out, off-pos)
+		for i := range x {
+			out = append(out, x[i]^y[i])
+		}
+		out = append(out, 0)
+		pos = off + int64(len(x)) + 1
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return finishROMPatch(out, old, new)
+}
+
+func applyBPS(orig *Buffer, r io.Reader) (*Buffer, error) {
+	body, crcs, err := readROMPatch(r, bpsMagic)
+	if err != nil {
+		return nil, err
+	}
+	var sizes [3]int64 //source, target, metadata
+	for i := range sizes {
+		if sizes[i], err = romInt(body); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := patchBytes(body, sizes[2]); err != nil {
+		return nil, err
+	}
+	if orig.size() != sizes[0] {
+		return nil, fmt.Errorf("%w: the BPS patch is for a different file", ErrBadPatch)
+	}
+	if crc, err := orig.CRC32(0, orig.size()); err != nil {
+		return nil, err
+	} else if crc != crcs[0] {
+		return nil, fmt.Errorf("%w: the BPS patch is for a different file", ErrBadPatch)
+	}
+
+	b := mkBuilder()
+	var srcRel, tgtRel int64
+	for body.Len() > 0 {
+		v, err := romInt(body)
+		if err != nil {
+			return nil, err
+		}
+		n := v>>2 + 1
+		if b.size()+n > sizes[1] {
+			return nil, fmt.Errorf("%w: BPS target is longer than %d bytes", ErrBadPatch, sizes[1])
+		}
+		switch v & 3 {
+		case bpsSourceRead:
+			err = b.copy(orig, b.size(), n)
+		case bpsTargetRead:
+			var p []byte
+			p, err = patchBytes(body, n)
+			b.add(p)
+		case bpsSourceCopy, bpsTargetCopy:
+			var d int64
+			if d, err = romInt(body); err != nil {
+				return nil, err
+			}
+			if d&1 != 0 {
+				d = -(d >> 1)
+			} else {
+				d >>= 1
+			}
+			if v&3 == bpsSourceCopy {
+				srcRel += d
+				err = b.copy(orig, srcRel, n)
+				srcRel += n
+			} else {
+				tgtRel += d
+				err = b.copySelf(tgtRel, n)
+				tgtRel += n
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b.size() != sizes[1] {
+		return nil, fmt.Errorf("%w: BPS target of %d bytes, expected %d", ErrBadPatch, b.size(), sizes[1])
+	}
+	return b.out, checkROMResult(b.out, crcs[1])
+}
+
+func makeBPS(old, new *Buffer, steps []DiffRange) ([]byte, error) {
+	out := append([]byte{}, bpsMagic...)
+	out = appendROMInt(out, old.size())
+	out = appendROMInt(out, new.size())
+	out = appendROMInt(out, 0) //no metadata
+	var srcRel int64
+	for _, st := range steps {
+		switch st.Op {
+		case DiffEqual:
+			if st.A == st.B {
+				out = appendROMInt(out, (st.Size-1)<<2|bpsSourceRead)
+				continue
+			}
+			out = appendROMInt(out, (st.Size-1)<<2|bpsSourceCopy)
+			if d := st.A - srcRel; d < 0 {
+				out = appendROMInt(out, -d<<1|1)
+			} else {
+				out = appendROMInt(out, d<<1)
+			}
+			srcRel = st.A + st.Size
+		case DiffInsert:
+			p, err := new.bytes(st.B, st.Size)
+			if err != nil {
+				return nil, err
+			}
+			out = appendROMInt(out, (st.Size-1)<<2|bpsTargetRead)
+			out = append(out, p...)
+		}
+	}
+	return finishROMPatch(out, old, new)
+}
+
+//overwrite fb at off with p, growing it with zeroes when off is past the end
+func (fb *Buffer) writeAt(p []byte, off int64) error {
+	fb.offset = off
+	_, err := fb.write(p)
+	return err
+}
+
+//calls cb with the offset and the bytes of a and b of every run of bytes
+//that differ between them, past their ends they count as zeroes
+func changedRuns(a, b *Buffer, cb func(off int64, x, y []byte) error) error {
+	size := a.size()
+	if b.size() > size {
+		size = b.size()
+	}
+	var start int64
+	var x, y []byte
+	flush := func() error {
+		if len(x) == 0 {
+			return nil
+		}
+		err := cb(start, x, y)
+		x, y = nil, nil
+		return err
+	}
+	for off := int64(0); off < size; off += iterChunk {
+		n := minInt64(iterChunk, size-off)
+		p, err := paddedBytes(a, off, n)
+		if err != nil {
+			return err
+		}
+		q, err := paddedBytes(b, off, n)
+		if err != nil {
+			return err
+		}
+		for i := range p {
+			if p[i] != q[i] {
+				if len(x) == 0 {
+					start = off + int64(i)
+				}
+				x, y = append(x, p[i]), append(y, q[i])
+			} else if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+//read a UPS or BPS patch and check its crc, returns what's between the
+//magic and the crc's, and the crc's of the source and the target
+func readROMPatch(r io.Reader, magic []byte) (*bytes.Reader, [2]uint32, error) {
+	var crcs [2]uint32
+	patch, err := io.ReadAll(r)
+	if err != nil {
+		return nil, crcs, err
+	}
+	if len(patch) < len(magic)+12 || !bytes.Equal(patch[:len(magic)], magic) {
+		return nil, crcs, fmt.Errorf("%w: not a %s patch", ErrBadPatch, magic[:3])
+	}
+	footer := patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, crcs, fmt.Errorf("%w: patch checksum mismatch", ErrBadPatch)
+	}
+	crcs[0] = binary.LittleEndian.Uint32(footer)
+	crcs[1] = binary.LittleEndian.Uint32(footer[4:])
+	return bytes.NewReader(patch[len(magic) : len(patch)-12]), crcs, nil
+}
+
+//append the crc's of old, new and the patch
+func finishROMPatch(patch []byte, old, new *Buffer) ([]byte, error) {
+	for _, fb := range []*Buffer{old, new} {
+		crc, err := fb.CRC32(0, fb.size())
+		if err != nil {
+			return nil, err
+		}
+		patch = appendUint32(patch, crc)
+	}
+	return appendUint32(patch, crc32.ChecksumIEEE(patch)), nil
+}
+
+func checkROMResult(fb *Buffer, want uint32) error {
+	crc, err := fb.CRC32(0, fb.size())
+	if err == nil && crc != want {
+		err = fmt.Errorf("%w: the patched buffer has the wrong checksum", ErrBadPatch)
+	}
+	return err
+}
+
+//the integers of UPS and BPS: 7 bits per byte, little endian, the top bit
+//marks the last byte; every byte but the last also adds one
+func romInt(r io.ByteReader) (int64, error) {
+	var v int64
+	shift := int64(1)
+	for i := 0; i < 9; i++ {
+		c, err := patchByte(r)
+		if err != nil {
+			return 0, err
+		}
+		v += int64(c&0x7f) * shift
+		if c&0x80 != 0 {
+			return v, nil
+		}
+		shift <<= 7
+		v += shift
+	}
+	return 0, fmt.Errorf("%w: integer too large", ErrBadPatch)
+}
+
+func appendROMInt(b []byte, v int64) []byte {
+	for {
+		x := byte(v & 0x7f)
+		if v >>= 7; v == 0 {
+			return append(b, x|0x80)
+		}
+		b = append(b, x)
+		v--
+	}
+}
@@ -0,0 +1,263 @@
+package filebuf
+
+/* Saving
+   The pieces of a buffer read from its backing file, so we can't just
+   truncate that file and write the buffer to it. Two strategies:
+
+   - in place: if every piece that refers to the backing file still sits
+     at its original offset, nothing we need to read is ever overwritten.
+     Then only the other pieces are written, and the file is truncated.
+     This is the common case for a hex editor (overwrite some bytes, append).
+   - otherwise the buffer is written to a temporary file in the same
+     directory, which is renamed over the original. Our open handle still
+     refers to the old file, so reading from it keeps working.
+
+   Afterwards the buffer is a single piece of the saved file again.
+   Holes stay holes, see sparse.go.
+
+   Compressed output (see WithCompression) is always written to a temporary
+   file. A buffer opened with OpenCompressed is saved in its own format.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var errSaveNoFile = errors.New("filebuf: buffer has no single file to save to, use SaveAs")
+
+//Save writes the contents of fb back to the file it was opened from
+//If that file was changed on disk in the meantime, Save refuses (see CheckBacking).
+//The old file is closed, other buffers that share pieces of it with fb
+//(made with Copy or Cut) can't be read after this.
+func (fb *Buffer) Save() error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if len(fb.backing) != 1 {
+		return errSaveNoFile
+	}
+	b := fb.backing[0]
+	return fb.save(b.path, &saveConfig{format: b.format})
+}
+
+//SaveAs writes the contents of fb to the file at path
+//By default the file is written uncompressed, see WithCompression.
+//If path is the file fb was opened from, this is the same as Save: without
+//WithCompression the file is written in the format it was opened in.
+func (fb *Buffer) SaveAs(path string, opts ...SaveOption) error {
+	var cfg saveConfig
+	for _, o := range opts {
+		o(&cfg)
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.save(path, &cfg)
+}
+
+func (fb *Buffer) save(path string, cfg *saveConfig) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var b *backing
+	if len(fb.backing) == 1 && fb.backing[0].path == abs {
+		b = fb.backing[0]
+	}
+	if b != nil && !cfg.formatSet {
+		cfg.format = b.format
+	}
+	if b == nil {
+		mode := os.FileMode(0644)
+		if info, err := os.Stat(abs); err == nil {
+			mode = info.Mode().Perm()
+		}
+		return fb.saveRename(abs, mode, cfg)
+	}
+
+	//we have to read the file back after saving
+	if !cfg.format.seekable() {
+		return fmt.Errorf("filebuf: can't save a buffer over its own file as %v", cfg.format)
+	}
+	if err := b.check(); err != nil {
+		return err
+	}
+	mode := b.lock
+	if mode == LockShared {
+		if err := b.lockAs(LockExclusive); err != nil {
+			//converting a flock isn't atomic, make sure we hold on to the shared lock
+			b.lockAs(LockShared)
+			return err
+		}
+	}
+	if cfg.format == NoCompression && b.format == NoCompression && fb.inPlace(b) {
+		//last chance to cancel
+		if err = cfg.task.step(0); err == nil {
+			err = fb.saveInPlace(b, cfg.task)
+		}
+	} else {
+		err = fb.saveRename(abs, b.info.Mode().Perm(), cfg)
+	}
+	if err != nil {
+		b.lockAs(mode)
+		return err
+	}
+
+	//start over with the saved file
+	nb, err := b.reopen(cfg.format)
+	if err != nil {
+		return err
+	}
+	if mode == LockShared {
+		nb.unlock()
+		nb.lockAs(LockShared)
+	}
+	fb.crcs.forget(b.file)
+	fb.backing = []*backing{nb}
+	fb.setPieces(nb.contents())
+	fb.retire([]*backing{b})
+	if fb.watcher != nil {
+		fb.watcher.add(fb.backing)
+	}
+	if fb.journal != nil {
+		return fb.journal.reset(fb)
+	}
+	return nil
+}
+
+//can fb be written over its backing file b, without overwriting data we still need?
+//that is the case if every piece that reads from b sits at its original offset
+func (fb *Buffer) inPlace(b *backing) bool {
+	same := map[io.ReaderAt]bool{b.file: true}
+	inplace := true
+	var off int64
+	fb.root.iter(func(n *node) bool {
+		if f, ok := n.data.(*fileData); ok && f.offset != off && refersTo(f.file, b, same) {
+			inplace = false
+		}
+		off += n.data.Size()
+		return !inplace
+	})
+	return inplace
+}
+
+//does r read from the same file as b? (it might be another handle to the same file)
+//the answers are cached in 'same'
+func refersTo(r io.ReaderAt, b *backing, same map[io.ReaderAt]bool) bool {
+	is, known := same[r]
+	if !known {
+		if f, ok := r.(*os.File); ok {
+			info, err := f.Stat()
+			//when in doubt, assume it does
+			is = err != nil || os.SameFile(info, b.info)
+		}
+		same[r] = is
+	}
+	return is
+}
+
+//write the pieces that aren't at their original offset in b, truncate the rest
+//t only gets progress, this can't be stopped halfway
+func (fb *Buffer) saveInPlace(b *backing, t *task) error {
+	f, err := os.OpenFile(b.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := &offsetWriter{file: f}
+	var off int64
+	fb.root.iter(func(n *node) bool {
+		//pieces of the file (holes too) that didn't move are there already,
+		//holes are punched, not written (if the filesystem lets us)
+		_, src, _ := fileSource(n.data)
+		if !b.owns(n.data) || src != off {
+			if !isHole(n.data) || punchHole(f, off, n.data.Size()) != nil {
+				w.off = off
+				_, err = n.data.WriteTo(w)
+			}
+		}
+		off += n.data.Size()
+		t.step(n.data.Size())
+		return err != nil
+	})
+	if err == nil {
+		err = f.Truncate(fb.size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	return err
+}
+
+//write fb to a temporary file next to path, and move that over path
+func (fb *Buffer) saveRename(path string, mode os.FileMode, cfg *saveConfig) error {
+	dir, base := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+base+".filebuf-")
+	if err != nil {
+		return err
+	}
+	if cfg.format == NoCompression {
+		err = fb.writeSparse(tmp, cfg.task)
+	} else {
+		//buffered, the compressors like big writes
+		w := bufio.NewWriterSize(tmp, 64*1024)
+		var cw io.WriteCloser
+		if cw, err = compressWriter(w, cfg); err == nil {
+			_, err = fb.writeTo(cfg.task.writer(cw))
+			if e := cw.Close(); err == nil {
+				err = e
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+	}
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+//write all pieces to w, like dump but with error handling
+func (fb *Buffer) writeTo(w io.Writer) (int64, error) {
+	var total int64
+	var err error
+	fb.root.iter(func(n *node) bool {
+		var written int64
+		written, err = n.data.WriteTo(w)
+		total += written
+		if err == nil && written != n.data.Size() {
+			err = io.ErrShortWrite
+		}
+		return err != nil
+	})
+	return total, err
+}
+
+//turns Writes into WriteAt's at a moving offset
+type offsetWriter struct {
+	file *os.File
+	off  int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
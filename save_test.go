@@ -0,0 +1,259 @@
+package filebuf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+//create a temporary file holding data
+func tempFile(t *testing.T, data []byte) string {
+	f, err := os.CreateTemp("", "TESTFILE")
+	if err != nil {
+		t.Fatalf("Couldn't create tempfile: %v", err)
+	}
+	f.Write(data)
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+func checkFile(t *testing.T, name string, want []byte) {
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s has the wrong contents:\n%q\nshould be\n%q", name, got, want)
+	}
+}
+
+func TestSaveInPlace(t *testing.T) {
+	name := tempFile(t, testdata)
+	before, _ := os.Stat(name)
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestSaveInPlace: OpenFile: %v", err)
+	}
+	want := append([]byte{}, testdata...)
+	copy(want[6:], "WORLD")
+	want = append(want, helloworld...)
+
+	b.Seek(6, io.SeekStart)
+	b.Write([]byte("WORLD"))
+	b.Insert(b.Size(), helloworld)
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestSaveInPlace: Save: %v", err)
+	}
+	checkFile(t, name, want)
+	after, _ := os.Stat(name)
+	if !os.SameFile(before, after) {
+		t.Fatal("TestSaveInPlace: file was replaced instead of written in place")
+	}
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestSaveInPlace: buffer changed by saving")
+	}
+
+	//shrinking is done in place too
+	b.Remove(10, b.Size()-10)
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestSaveInPlace: Save: %v", err)
+	}
+	checkFile(t, name, want[:10])
+}
+
+func TestTruncateResize(t *testing.T) {
+	name := tempFile(t, testdata)
+	before, _ := os.Stat(name)
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestTruncateResize: OpenFile: %v", err)
+	}
+	defer b.Close()
+
+	//shrinking and growing are saved in place
+	if err := b.Truncate(10); err != nil {
+		t.Fatalf("TestTruncateResize: Truncate: %v", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestTruncateResize: Save: %v", err)
+	}
+	checkFile(t, name, testdata[:10])
+	if err := b.Truncate(15); err != nil {
+		t.Fatalf("TestTruncateResize: Truncate: %v", err)
+	}
+	if err := b.Resize(20, 'x'); err != nil {
+		t.Fatalf("TestTruncateResize: Resize: %v", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestTruncateResize: Save: %v", err)
+	}
+	checkFile(t, name, append(append(append([]byte{}, testdata[:10]...), 0, 0, 0, 0, 0), "xxxxx"...))
+	after, _ := os.Stat(name)
+	if !os.SameFile(before, after) {
+		t.Fatal("TestTruncateResize: file was replaced after resizing")
+	}
+	if err := b.Resize(-1, 0); err == nil || !strings.Contains(err.Error(), "Resize") {
+		t.Fatalf("TestTruncateResize: negative size: %v", err)
+	}
+}
+
+func TestSaveReloadFiles(t *testing.T) {
+	if _, err := os.ReadDir("/proc/self/fd"); err != nil {
+		t.Skip("can't count open files")
+	}
+	open := func() int {
+		fds, _ := os.ReadDir("/proc/self/fd")
+		return len(fds)
+	}
+	name := tempFile(t, testdata)
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestSaveReloadFiles: OpenFile: %v", err)
+	}
+	defer b.Close()
+	before := open()
+	for i := 0; i < 10; i++ {
+		b.Insert(0, []byte("x"))
+		if err := b.Save(); err != nil {
+			t.Fatalf("TestSaveReloadFiles: Save: %v", err)
+		}
+		if err := b.Reload(i%2 == 0); err != nil {
+			t.Fatalf("TestSaveReloadFiles: Reload: %v", err)
+		}
+	}
+	if after := open(); after != before {
+		t.Fatalf("TestSaveReloadFiles: %d open files before, %d after", before, after)
+	}
+}
+
+func TestSaveRename(t *testing.T) {
+	name := tempFile(t, testdata)
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestSaveRename: OpenFile: %v", err)
+	}
+	//moves the file data, so it can't be saved in place
+	b.Insert(0, helloworld)
+	b.Paste(b.Size(), b.Copy(0, 20))
+	b.Seek(0, io.SeekStart)
+	want, _ := io.ReadAll(b)
+
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestSaveRename: Save: %v", err)
+	}
+	checkFile(t, name, want)
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestSaveRename: buffer changed by saving")
+	}
+
+	other := name + ".other"
+	defer os.Remove(other)
+	b.Insert(0, testdata_line2)
+	if err := b.SaveAs(other); err != nil {
+		t.Fatalf("TestSaveRename: SaveAs: %v", err)
+	}
+	checkFile(t, other, append(append([]byte{}, testdata_line2...), want...))
+	checkFile(t, name, want)
+}
+
+func TestLock(t *testing.T) {
+	name := tempFile(t, testdata)
+	b1, err := OpenFile(name, WithLock(LockShared))
+	if err != nil {
+		t.Skipf("TestLock: can't lock files here: %v", err)
+	}
+	b2, err := OpenFile(name, WithLock(LockShared))
+	if err != nil {
+		t.Fatalf("TestLock: second shared lock: %v", err)
+	}
+	if _, err := OpenFile(name, WithLock(LockExclusive)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TestLock: exclusive lock while shared locks are held: %v", err)
+	}
+
+	b1.Insert(0, helloworld)
+	if err := b1.Save(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TestLock: save while someone else holds a lock: %v", err)
+	}
+	if err := b2.Close(); err != nil {
+		t.Fatalf("TestLock: Close: %v", err)
+	}
+	if err := b1.Save(); err != nil {
+		t.Fatalf("TestLock: save after the other lock was released: %v", err)
+	}
+	checkFile(t, name, append(append([]byte{}, helloworld...), testdata...))
+
+	//b1 still holds a shared lock on the saved file
+	if _, err := OpenFile(name, WithLock(LockExclusive)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TestLock: exclusive lock after save: %v", err)
+	}
+	b1.Close()
+	b3, err := OpenFile(name, WithLock(LockExclusive))
+	if err != nil {
+		t.Fatalf("TestLock: exclusive lock after Close: %v", err)
+	}
+	b3.Close()
+}
+
+func TestConcat(t *testing.T) {
+	names := []string{tempFile(t, testdata), tempFile(t, nil), tempFile(t, helloworld)}
+	b, err := OpenFiles(names)
+	if err != nil {
+		t.Fatalf("TestConcat: OpenFiles: %v", err)
+	}
+	defer b.Close()
+	want := append(append([]byte{}, testdata...), helloworld...)
+	if !compareBuf2Bytes(b, want) {
+		t.Fatal("TestConcat: OpenFiles contents wrong")
+	}
+	if err := b.Save(); err == nil {
+		t.Fatal("TestConcat: Save of several files should fail")
+	}
+
+	c := Concat(b, NewMem(testdata_line2), b)
+	want2 := append(append(append([]byte{}, want...), testdata_line2...), want...)
+	if !compareBuf2Bytes(c, want2) {
+		t.Fatal("TestConcat: Concat contents wrong")
+	}
+
+	prefix := tempFile(t, nil)
+	parts, err := c.SaveSplit(prefix, 100)
+	if err != nil {
+		t.Fatalf("TestConcat: SaveSplit: %v", err)
+	}
+	for _, p := range parts {
+		defer os.Remove(p)
+	}
+	if len(parts) != (len(want2)+99)/100 {
+		t.Fatalf("TestConcat: SaveSplit wrote %d parts", len(parts))
+	}
+	joined, err := OpenFiles(parts)
+	if err != nil {
+		t.Fatalf("TestConcat: OpenFiles(parts): %v", err)
+	}
+	defer joined.Close()
+	if !compareBuf2Bytes(joined, want2) {
+		t.Fatal("TestConcat: split parts don't add up")
+	}
+
+	//nothing at all
+	if _, err := OpenFiles(nil); err == nil {
+		t.Fatal("TestConcat: OpenFiles without files")
+	}
+	parts, err = NewEmpty().SaveSplit(prefix, 100)
+	if err != nil || len(parts) != 1 {
+		t.Fatalf("TestConcat: SaveSplit of an empty buffer: %v, %v", parts, err)
+	}
+	defer os.Remove(parts[0])
+	empty, err := OpenFiles(parts)
+	if err != nil {
+		t.Fatalf("TestConcat: OpenFiles(empty part): %v", err)
+	}
+	defer empty.Close()
+	if empty.Size() != 0 {
+		t.Fatalf("TestConcat: empty part has %d bytes", empty.Size())
+	}
+}
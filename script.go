@@ -0,0 +1,388 @@
+package filebuf
+
+/* Edit scripts
+   While recording, every edit of a buffer goes into an EditScript, the same
+   edits the journal sees. Pasted pieces of the original are kept as copies
+   from the original, so pasting a big part of a file costs a few bytes.
+   Inserts right after each other and deletes next to each other are merged:
+   typing a word is one edit, and so is backspacing over it.
+
+   Other inserted pieces are shared with the buffer, like a Copy, except
+   for pieces of the scratch file and of a stream: those go away when the
+   buffer is closed, so they are read into memory.
+
+   A script replays on a buffer opened from the same original (its backing
+   files, one after the other) that is in the state the recorded buffer was
+   in when recording started. If the original was opened WithHash, the
+   script keeps the hashes and a replay with copies checks them. A script
+   without copies, a macro, replays on any buffer that is big enough.
+
+   The binary form is
+     "FBS1" | varint size of the original | varint size of hash | hash | records
+   where a record is a record of the journal. The JSON form is
+     {"original": size, "hash": base64, "edits": [{"op": "insert", "offset": 5, "data": base64}, ...]}
+   with ops insert (data), delete (size), copy (size, src) and fill (size, pattern).
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Unmarshalling returns this error if the data isn't an edit script
+var ErrBadScript = errors.New("filebuf: bad edit script")
+
+var scriptMagic = []byte("FBS1")
+
+var opNames = map[editOp]string{
+	opInsert: "insert",
+	opDelete: "delete",
+	opCopy:   "copy",
+	opFill:   "fill",
+}
+
+//EditScript is a list of edits, see StartRecording
+//Like a Copy, a recorded script shares pieces with the buffer it was recorded on,
+//but it can still be marshalled after Close: pieces of the scratch file or a
+//stream are kept in memory.
+type EditScript struct {
+	original int64  //size of the original
+	hash     []byte //sha256 of every backing file, if they were opened WithHash
+	edits    []*edit
+	origins  *origins //while recording, nil if there is no original
+}
+
+//StartRecording records all subsequent edits of fb in an edit script
+func (fb *Buffer) StartRecording() error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.script != nil {
+		return errors.New("filebuf: already recording")
+	}
+	s := &EditScript{}
+	if len(fb.backing) > 0 {
+		s.origins = fb.origins()
+		for _, b := range fb.backing {
+			s.original += b.length
+			s.hash = append(s.hash, b.hash...)
+		}
+		if len(s.hash) != len(fb.backing)*sha256.Size {
+			s.hash = nil
+		}
+	}
+	fb.script = s
+	return nil
+}
+
+//StopRecording stops recording and returns the edits made since StartRecording,
+//nil if fb wasn't recording
+func (fb *Buffer) StopRecording() *EditScript {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	s := fb.script
+	fb.script = nil
+	if s != nil {
+		s.origins = nil
+	}
+	return s
+}
+
+//Replay applies the edits of s to fb
+//If s doesn't fit fb, an error is returned and fb isn't changed.
+func (fb *Buffer) Replay(s *EditScript) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	orig := fb.original()
+	if err := s.check(fb.size(), orig.size(), fb.originalHash); err != nil {
+		return err
+	}
+	for _, e := range s.edits {
+		if err := fb.replay(e, orig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//the contents of the backing files, one after the other
+func (fb *Buffer) original() *Buffer {
+	var pieces []data
+	for _, b := range fb.backing {
+		pieces = append(pieces, b.contents()...)
+	}
+	orig := &Buffer{}
+	orig.setPieces(pieces)
+	return orig
+}
+
+//the hashes of the backing files, one after the other
+//files that weren't opened WithHash are hashed now
+func (fb *Buffer) originalHash() ([]byte, error) {
+	var h []byte
+	for _, b := range fb.backing {
+		bh := b.hash
+		if bh == nil {
+			var err error
+			if bh, err = hashFile(b.path); err != nil {
+				return nil, err
+			}
+		}
+		h = append(h, bh...)
+	}
+	return h, nil
+}
+
+//Len returns the number of edits in s
+func (s *EditScript) Len() int {
+	return len(s.edits)
+}
+
+//add a recorded edit of fb, a pasted tree is split in its pieces
+func (s *EditScript) add(fb *Buffer, e *edit) {
+	if e.size == 0 {
+		return
+	}
+	if e.tree == nil {
+		c := *e
+		c.data = append([]byte{}, e.data...)
+		s.merge(&c)
+		return
+	}
+	off := e.off
+	e.tree.root.iter(func(n *node) bool {
+		sz := n.data.Size()
+		if sz == 0 {
+			return false
+		}
+		if src, ok := s.fromOriginal(n.data); ok {
+			s.merge(&edit{op: opCopy, off: off, size: sz, src: src})
+		} else if f, ok := n.data.(*fillData); ok {
+			s.merge(&edit{op: opFill, off: off, size: sz, data: f.rotated()})
+		} else if b, ok := fb.temporary(n.data); ok {
+			s.merge(&edit{op: opInsert, off: off, size: sz, data: b})
+		} else {
+			s.merge(&edit{op: opInsert, off: off, size: sz, tree: &Buffer{root: mkNode(n.data.Copy())}})
+		}
+		off += sz
+		return false
+	})
+}
+
+//the contents of d if it is a piece of a file that is closed with fb
+//(the scratch file, a stream), false if it isn't or can't be read
+func (fb *Buffer) temporary(d data) ([]byte, bool) {
+	f, _, ok := fileSource(d)
+	if !ok {
+		return nil, false
+	}
+	scratch := fb.scratch != nil && f == io.ReaderAt(fb.scratch.file)
+	spool := fb.stream != nil && f == io.ReaderAt(fb.stream.spool)
+	if !scratch && !spool {
+		return nil, false
+	}
+	b := make([]byte, d.Size())
+	if _, err := d.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, false
+	}
+	return b, true
+}
+
+//the offset in the original of d, false if it's not from the original
+func (s *EditScript) fromOriginal(d data) (int64, bool) {
+	if s.origins == nil {
+		return 0, false
+	}
+	return s.origins.of(d, 0)
+}
+
+//append e, or merge it with the last edit if they are next to each other
+func (s *EditScript) merge(e *edit) {
+	if n := len(s.edits); n > 0 {
+		l := s.edits[n-1]
+		switch {
+		case e.op == opInsert && l.op == opInsert && e.tree == nil && l.tree == nil && e.off == l.off+l.size:
+			l.data = append(l.data, e.data...)
+			l.size += e.size
+			return
+		case e.op == opDelete && l.op == opDelete && (e.off == l.off || e.off+e.size == l.off):
+			l.off = e.off
+			l.size += e.size
+			return
+		}
+	}
+	s.edits = append(s.edits, e)
+}
+
+//check that the edits of s fit a buffer of size bytes, opened from an original of orig bytes
+//hash is only called if s has copies from the original
+func (s *EditScript) check(size, orig int64, hash func() ([]byte, error)) error {
+	hashed := false
+	for i, e := range s.edits {
+		bad := e.off < 0 || e.size < 0 || e.off > size
+		switch e.op {
+		case opInsert:
+		case opDelete:
+			bad = bad || e.size > size-e.off
+		case opCopy:
+			if orig != s.original {
+				return fmt.Errorf("filebuf: edit script needs an original of %d bytes, not %d", s.original, orig)
+			}
+			if s.hash != nil && !hashed {
+				h, err := hash()
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(h, s.hash) {
+					return errors.New("filebuf: edit script was recorded on another original")
+				}
+				hashed = true
+			}
+			bad = bad || e.src < 0 || e.size > orig-e.src
+		case opFill:
+			bad = bad || len(e.data) == 0
+		default:
+			bad = true
+		}
+		if bad {
+			return fmt.Errorf("filebuf: edit %d of the script doesn't fit the buffer", i+1)
+		}
+		if e.op == opDelete {
+			size -= e.size
+		} else {
+			size += e.size
+		}
+	}
+	return nil
+}
+
+//MarshalBinary returns the binary form of s
+func (s *EditScript) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	b.Write(scriptMagic)
+	b.Write(appendVarint(nil, s.original))
+	b.Write(appendVarint(nil, int64(len(s.hash))))
+	b.Write(s.hash)
+	for _, e := range s.edits {
+		if err := writeEdit(&b, e); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+//UnmarshalBinary sets s to the script in p, in binary form
+func (s *EditScript) UnmarshalBinary(p []byte) error {
+	r := bufio.NewReader(bytes.NewReader(p))
+	magic := make([]byte, len(scriptMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, scriptMagic) {
+		return ErrBadScript
+	}
+	original, err := binary.ReadVarint(r)
+	if err != nil {
+		return ErrBadScript
+	}
+	n, err := binary.ReadVarint(r)
+	if err != nil || (n != 0 && n%sha256.Size != 0) || n > int64(len(p)) {
+		return ErrBadScript
+	}
+	var hash []byte
+	if n > 0 {
+		hash = make([]byte, n)
+		if _, err := io.ReadFull(r, hash); err != nil {
+			return ErrBadScript
+		}
+	}
+	var edits []*edit
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			break
+		}
+		e, err := readEdit(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadScript, err)
+		}
+		edits = append(edits, e)
+	}
+	*s = EditScript{original: original, hash: hash, edits: edits}
+	return nil
+}
+
+//an edit in JSON
+type jsonEdit struct {
+	Op      string `json:"op"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size,omitempty"`
+	Src     int64  `json:"src,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Pattern []byte `json:"pattern,omitempty"`
+}
+
+type jsonScript struct {
+	Original int64      `json:"original"`
+	Hash     []byte     `json:"hash,omitempty"`
+	Edits    []jsonEdit `json:"edits"`
+}
+
+//MarshalJSON returns the JSON form of s
+func (s *EditScript) MarshalJSON() ([]byte, error) {
+	js := jsonScript{Original: s.original, Hash: s.hash, Edits: []jsonEdit{}}
+	for _, e := range s.edits {
+		je := jsonEdit{Op: opNames[e.op], Offset: e.off}
+		switch e.op {
+		case opInsert:
+			je.Data = e.data
+			if e.tree != nil {
+				b, err := e.tree.bytes(0, e.size)
+				if err != nil {
+					return nil, err
+				}
+				je.Data = b
+			}
+		case opCopy:
+			je.Size, je.Src = e.size, e.src
+		case opFill:
+			je.Size, je.Pattern = e.size, e.data
+		default:
+			je.Size = e.size
+		}
+		js.Edits = append(js.Edits, je)
+	}
+	return json.Marshal(js)
+}
+
+//UnmarshalJSON sets s to the script in p, in JSON form
+func (s *EditScript) UnmarshalJSON(p []byte) error {
+	var js jsonScript
+	if err := json.Unmarshal(p, &js); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadScript, err)
+	}
+	if len(js.Hash)%sha256.Size != 0 {
+		return fmt.Errorf("%w: bad hash", ErrBadScript)
+	}
+	var edits []*edit
+	for i, je := range js.Edits {
+		e := &edit{off: je.Offset, size: je.Size, src: je.Src}
+		for op, name := range opNames {
+			if name == je.Op {
+				e.op = op
+			}
+		}
+		switch e.op {
+		case opInsert:
+			e.data, e.size = je.Data, int64(len(je.Data))
+		case opFill:
+			e.data = je.Pattern
+		case 0:
+			return fmt.Errorf("%w: edit %d has unknown op %q", ErrBadScript, i+1, je.Op)
+		}
+		edits = append(edits, e)
+	}
+	*s = EditScript{original: js.Original, hash: js.Hash, edits: edits}
+	return nil
+}
@@ -0,0 +1,97 @@
+package filebuf
+
+/* Sparse files
+   Disk images and the like are mostly holes. When a file is opened, the holes
+   are looked up (where the platform can do that, see sparse_*.go) and become
+   zero fill pieces, so reading them doesn't touch the disk. A hole piece
+   remembers where it is in the file, so it is still part of the original
+   (see provenance.go) and Reload reads what's there now.
+   When saving, zero fill pieces are not written: in place they are punched
+   out of the file, a new file just skips over them.
+*/
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+//the pieces of file f of size bytes, holes are zero fill pieces
+func sparsePieces(f io.ReaderAt, size int64) []data {
+	if size == 0 {
+		return nil
+	}
+	whole := []data{&fileData{file: f, size: size}}
+	file, ok := f.(*os.File)
+	if !ok {
+		return whole
+	}
+	regions := dataRegions(file, size)
+	if regions == nil {
+		return whole
+	}
+	var pieces []data
+	var off int64
+	for _, r := range regions {
+		if r[0] > off {
+			pieces = append(pieces, mkHole(f, off, r[0]-off))
+		}
+		pieces = append(pieces, &fileData{file: f, offset: r[0], size: r[1] - r[0]})
+		off = r[1]
+	}
+	if off < size {
+		pieces = append(pieces, mkHole(f, off, size-off))
+	}
+	return pieces
+}
+
+//size bytes of the hole at off in f
+func mkHole(f io.ReaderAt, off, size int64) *fillData {
+	return &fillData{pattern: []byte{0}, size: size, file: f, offset: off}
+}
+
+//is d a piece of zeroes big enough to leave a hole for?
+func isHole(d data) bool {
+	f, ok := d.(*fillData)
+	if !ok || f.size < maxBufLen {
+		return false
+	}
+	for _, b := range f.pattern {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//write fb to f, skip over the holes
+//t (can be nil) counts the bytes and can stop the writing
+func (fb *Buffer) writeSparse(f *os.File, t *task) error {
+	w := bufio.NewWriterSize(t.writer(f), 64*1024)
+	var err error
+	fb.root.iter(func(n *node) bool {
+		if isHole(n.data) {
+			if err = w.Flush(); err == nil {
+				_, err = f.Seek(n.data.Size(), io.SeekCurrent)
+			}
+			if err == nil {
+				err = t.step(n.data.Size())
+			}
+		} else {
+			var written int64
+			written, err = n.data.WriteTo(w)
+			if err == nil && written != n.data.Size() {
+				err = io.ErrShortWrite
+			}
+		}
+		return err != nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		//a hole at the end
+		err = f.Truncate(fb.size())
+	}
+	return err
+}
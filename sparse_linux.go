@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package filebuf
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 //SEEK_DATA
+	seekHole = 4 //SEEK_HOLE
+
+	fallocKeepSize  = 0x1 //FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x2 //FALLOC_FL_PUNCH_HOLE
+)
+
+//the [start, end) ranges of f that hold data
+//nil if f has no holes, or the filesystem can't tell
+func dataRegions(f *os.File, size int64) [][2]int64 {
+	fd := int(f.Fd())
+	var regions [][2]int64
+	for off := int64(0); off < size; {
+		start, err := syscall.Seek(fd, off, seekData)
+		if err == syscall.ENXIO {
+			break //only a hole after off
+		} else if err != nil {
+			return nil
+		}
+		end, err := syscall.Seek(fd, start, seekHole)
+		if err != nil {
+			return nil
+		}
+		if end > size {
+			end = size
+		}
+		regions = append(regions, [2]int64{start, end})
+		off = end
+	}
+	if len(regions) == 1 && regions[0] == [2]int64{0, size} {
+		return nil
+	}
+	return regions
+}
+
+//deallocate size bytes at off in f, they read as zeroes after this
+func punchHole(f *os.File, off, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, off, size)
+}
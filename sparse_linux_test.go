@@ -0,0 +1,113 @@
+package filebuf
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+//bytes allocated on disk for the file at name
+func allocated(name string) int64 {
+	var st syscall.Stat_t
+	syscall.Stat(name, &st)
+	return st.Blocks * 512
+}
+
+func TestSparse(t *testing.T) {
+	const size = 1 << 30
+	name := tempFile(t, nil)
+	f, _ := os.OpenFile(name, os.O_WRONLY, 0)
+	f.WriteAt(testdata, 0)
+	f.WriteAt(helloworld, size/2)
+	f.Truncate(size)
+	f.Close()
+
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestSparse: OpenFile: %v", err)
+	}
+	defer b.Close()
+	if b.Stats().FillBytes == 0 {
+		t.Skip("TestSparse: filesystem doesn't report holes")
+	}
+	if b.Size() != size {
+		t.Fatalf("TestSparse: size %d, should be %d", b.Size(), size)
+	}
+	buf := make([]byte, len(helloworld)+10)
+	b.Seek(size/2-10, io.SeekStart)
+	b.Read(buf)
+	if !bytes.Equal(buf, append(make([]byte, 10), helloworld...)) {
+		t.Fatal("TestSparse: read around the data in the middle went wrong")
+	}
+
+	//in place
+	b.Insert(size/4, testdata_line2)
+	b.Remove(size/4, int64(len(testdata_line2)))
+	b.Fill(1000, 100, []byte("x"))
+	if err := b.Save(); err != nil {
+		t.Fatalf("TestSparse: Save: %v", err)
+	}
+	if a := allocated(name); a > size/16 {
+		t.Fatalf("TestSparse: saving in place allocated %d bytes", a)
+	}
+
+	//to a new file
+	b.Insert(0, helloworld)
+	other := name + ".other"
+	defer os.Remove(other)
+	if err := b.SaveAs(other); err != nil {
+		t.Fatalf("TestSparse: SaveAs: %v", err)
+	}
+	if a := allocated(other); a > size/16 {
+		t.Fatalf("TestSparse: SaveAs allocated %d bytes", a)
+	}
+	o, _ := OpenFile(other)
+	defer o.Close()
+	o.Seek(size/2+int64(len(helloworld)), io.SeekStart)
+	o.Read(buf[:len(helloworld)])
+	if o.Size() != size+int64(len(helloworld)) || !bytes.Equal(buf[:len(helloworld)], helloworld) {
+		t.Fatal("TestSparse: saved file is wrong")
+	}
+}
+
+func TestSparseOriginal(t *testing.T) {
+	const size = 1 << 20
+	name := tempFile(t, nil)
+	f, _ := os.OpenFile(name, os.O_WRONLY, 0)
+	f.WriteAt(bytes.Repeat(testdata, 4096/len(testdata)+1)[:4096], 0)
+	f.Truncate(size)
+	f.Close()
+
+	b, err := OpenFile(name)
+	if err != nil {
+		t.Fatalf("TestSparseOriginal: OpenFile: %v", err)
+	}
+	defer b.Close()
+	if b.Stats().FillBytes == 0 {
+		t.Skip("TestSparseOriginal: filesystem doesn't report holes")
+	}
+	//holes are part of the original
+	if m := b.ModifiedRanges(); len(m) != 0 {
+		t.Fatalf("TestSparseOriginal: unedited file has modified ranges %v", m)
+	}
+	if off, ok := b.MapOriginalToCurrent(500000); off != 500000 || !ok {
+		t.Fatalf("TestSparseOriginal: MapOriginalToCurrent(500000) = %d, %v", off, ok)
+	}
+
+	//and Reload reads what is in them now
+	b.Insert(0, helloworld)
+	f, _ = os.OpenFile(name, os.O_WRONLY, 0)
+	f.WriteAt([]byte("ZZZZ"), 9000)
+	f.Close()
+	if err := b.Reload(true); err != nil {
+		t.Fatalf("TestSparseOriginal: Reload: %v", err)
+	}
+	buf := make([]byte, 4)
+	b.Seek(9000+int64(len(helloworld)), io.SeekStart)
+	b.Read(buf)
+	if string(buf) != "ZZZZ" {
+		t.Fatalf("TestSparseOriginal: after Reload the hole reads %q", buf)
+	}
+}
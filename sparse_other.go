@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package filebuf
+
+import (
+	"errors"
+	"os"
+)
+
+//finding holes is only implemented on linux, files are read as a whole here
+func dataRegions(f *os.File, size int64) [][2]int64 {
+	return nil
+}
+
+func punchHole(f *os.File, off, size int64) error {
+	return errors.New("filebuf: punching holes is not supported on this platform")
+}
@@ -0,0 +1,112 @@
+package filebuf
+
+/* Memory budget
+   Every insert ends up in a bufData piece, so a buffer that sees a lot of
+   pastes and inserts slowly eats all memory. When a memory limit is set,
+   cold bufData pieces are written to an append-only scratch file and
+   replaced by fileData pieces that point into it.
+   The tree keeps track of the amount of memory used (node.mem), just
+   like it does for the size, so checking the budget is O(1).
+*/
+
+import (
+	"os"
+)
+
+//SetMemoryLimit limits the amount of bytes fb keeps in memory pieces
+//When the limit is exceeded, cold pieces are moved to a scratch file until
+//usage drops to half the limit. A limit <= 0 disables the budget (the default).
+func (fb *Buffer) SetMemoryLimit(limit int64) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.memLimit = limit
+	return fb.spill()
+}
+
+//SetScratchDir sets the directory where the scratch file is created
+//The default is os.TempDir(). It has no effect once the scratch file exists.
+func (fb *Buffer) SetScratchDir(dir string) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.scratchDir = dir
+}
+
+//MemoryUsage returns the amount of bytes held in memory pieces
+func (fb *Buffer) MemoryUsage() int64 {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.root.mem
+}
+
+//move memory pieces to the scratch file if we are over budget
+func (fb *Buffer) spill() error {
+	if fb.memLimit <= 0 || fb.root.mem <= fb.memLimit {
+		return nil
+	}
+	if fb.scratch == nil {
+		s, err := mkScratch(fb.scratchDir)
+		if err != nil {
+			return err
+		}
+		fb.scratch = s
+	}
+
+	//the root is the node that was edited last, leave it alone.
+	//first get rid of frozen pieces, they won't be appended to anymore
+	excess := fb.root.mem - fb.memLimit/2
+	err := fb.root.spill(fb.scratch, fb.root, true, &excess)
+	if err == nil && excess > 0 {
+		err = fb.root.spill(fb.scratch, fb.root, false, &excess)
+	}
+	return err
+}
+
+//replace memory pieces in t (except for node 'skip') with pieces in the
+//scratch file, until 'excess' bytes are moved
+func (t *node) spill(s *scratchFile, skip *node, frozenOnly bool, excess *int64) error {
+	if t == nil || t.mem == 0 || *excess <= 0 {
+		return nil
+	}
+	defer t.resetSize()
+	if err := t.left.spill(s, skip, frozenOnly, excess); err != nil {
+		return err
+	}
+	if b, ok := t.data.(*bufData); ok && t != skip && b.Size() > 0 && *excess > 0 {
+		if b.frozen || !frozenOnly {
+			d, err := s.store(b.data)
+			if err != nil {
+				return err
+			}
+			t.data = d
+			*excess -= d.size
+		}
+	}
+	return t.right.spill(s, skip, frozenOnly, excess)
+}
+
+//an append-only file where memory pieces go to when over budget
+type scratchFile struct {
+	file *os.File
+	size int64
+}
+
+func mkScratch(dir string) (*scratchFile, error) {
+	f, err := os.CreateTemp(dir, "filebuf-scratch-")
+	if err != nil {
+		return nil, err
+	}
+	//nobody else needs to see this file; on unix it lives on until it is closed
+	os.Remove(f.Name())
+	return &scratchFile{file: f}, nil
+}
+
+//append b to the scratch file, return a piece referring to it
+func (s *scratchFile) store(b []byte) (*fileData, error) {
+	n, err := s.file.WriteAt(b, s.size)
+	if err != nil {
+		return nil, err
+	}
+	d := &fileData{file: s.file, offset: s.size, size: int64(n)}
+	s.size += int64(n)
+	return d, nil
+}
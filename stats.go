@@ -0,0 +1,65 @@
+package filebuf
+
+import "fmt"
+
+//Stats describes the shape of the tree behind a Buffer
+//It is meant for exporting metrics and deciding when a buffer is worth compacting
+type Stats struct {
+	Size int64 //size of the buffer in bytes
+
+	Nodes       int64 //total number of pieces in the tree
+	FileNodes   int64 //pieces that refer to a portion of a file
+	MemNodes    int64 //pieces that hold a byte slice (bufData)
+	FillNodes   int64 //pieces of a repeating pattern (fillData)
+	FrozenNodes int64 //memory pieces that can no longer be appended to
+	EmptyNodes  int64 //pieces of size 0
+	SmallNodes  int64 //non-empty pieces smaller than maxBufLen
+
+	MemBytes  int64 //bytes held in memory pieces
+	FileBytes int64 //bytes referenced in files
+	FillBytes int64 //bytes of repeating patterns
+
+	MaxDepth int64   //max distance of a piece to the root
+	AvgDepth float64 //average distance of a piece to the root
+
+	MinPieceSize int64
+	MaxPieceSize int64
+	AvgPieceSize float64
+
+	//Fragmentation is the fraction of pieces that are smaller than maxBufLen,
+	//a buffer that is a single piece is not fragmented at all.
+	//It goes to 1 as the buffer is chopped up into lots of tiny pieces.
+	Fragmentation float64
+}
+
+//Stats returns statistics about the tree behind fb
+//This walks the entire tree, so it is O(number of pieces)
+func (fb *Buffer) Stats() Stats {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.stats()
+}
+
+func (fb *Buffer) stats() Stats {
+	var st Stats
+	var depthsum int64
+	fb.root.stats(&st, 0, &depthsum)
+	if st.Nodes > 0 {
+		st.AvgDepth = float64(depthsum) / float64(st.Nodes)
+		st.AvgPieceSize = float64(st.Size) / float64(st.Nodes)
+	}
+	if st.Nodes > 1 {
+		st.Fragmentation = float64(st.SmallNodes+st.EmptyNodes) / float64(st.Nodes)
+	}
+	return st
+}
+
+func (st Stats) String() string {
+	return fmt.Sprintf("size = %d\n", st.Size) +
+		fmt.Sprintf("nodes = %d (file: %d, data: %d (fixed: %d), fill: %d, empty: %d)\n",
+			st.Nodes, st.FileNodes, st.MemNodes, st.FrozenNodes, st.FillNodes, st.EmptyNodes) +
+		fmt.Sprintf("bytes in memory: %d, bytes in files: %d, filled bytes: %d\n", st.MemBytes, st.FileBytes, st.FillBytes) +
+		fmt.Sprintf("avg node size: %f (min: %d, max: %d)\n", st.AvgPieceSize, st.MinPieceSize, st.MaxPieceSize) +
+		fmt.Sprintf("maxdepth: %d (avg: %f)\n", st.MaxDepth, st.AvgDepth) +
+		fmt.Sprintf("fragmentation: %f\n", st.Fragmentation)
+}
@@ -0,0 +1,204 @@
+package filebuf
+
+/* Streams
+   A buffer can be read from a stream that can't seek (a pipe, stdin).
+   The stream is read in the background into a spool: memory at first,
+   a temporary file once it gets big. Everything that arrives is appended
+   to the end of the buffer as a fileData piece of the spool, so the start
+   of the buffer can be viewed and edited before the stream is finished.
+   Appending is an edit like any other: a journal or edit script sees it
+   as an insert at the end.
+*/
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+//streams bigger than this are spooled to a temporary file
+var spoolMemLimit int64 = 1 << 20
+
+//the state of a buffer that is being read from a stream
+type stream struct {
+	done   chan struct{} //closed when the stream is finished
+	err    error         //why it finished, nil on EOF
+	closed bool          //the buffer was closed, stop reading
+	r      io.Reader
+	spool  *spool
+}
+
+//NewFromReader returns a buffer that fills up with the contents of r
+//r is read in the background, Size() grows while data is read and
+//new data is always appended to the end of the buffer.
+//Use WaitStream to wait for the end of the stream.
+//Close stops appending to fb, but r belongs to the caller and isn't closed:
+//a Read that blocks (on a pipe, stdin) keeps waiting until r is closed or
+//returns data. Close r to stop reading right away.
+func NewFromReader(r io.Reader) *Buffer {
+	fb := NewEmpty()
+	fb.stream = &stream{done: make(chan struct{}), r: r, spool: &spool{}}
+	fb.source = fb.stream.spool
+	go fb.follow(fb.stream)
+	return fb
+}
+
+//Streaming returns true if fb is still reading from a stream
+func (fb *Buffer) Streaming() bool {
+	fb.lock.Lock()
+	st := fb.stream
+	fb.lock.Unlock()
+	if st == nil {
+		return false
+	}
+	select {
+	case <-st.done:
+		return false
+	default:
+		return true
+	}
+}
+
+//WaitStream waits until the stream fb is read from is finished
+//It returns the error that ended the stream, or nil on a clean EOF.
+func (fb *Buffer) WaitStream() error {
+	fb.lock.Lock()
+	st := fb.stream
+	fb.lock.Unlock()
+	if st == nil {
+		return nil
+	}
+	<-st.done
+	return st.err
+}
+
+//stop reading the stream, called by Close
+//the reader isn't ours, follow stops once its Read returns
+func (st *stream) close() {
+	st.closed = true
+	st.spool.close()
+}
+
+//read the stream into its spool, append what we read to fb
+func (fb *Buffer) follow(st *stream) {
+	defer close(st.done)
+	s := st.spool
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := st.r.Read(buf)
+		if n > 0 {
+			off := s.Size()
+			if e := s.append(buf[:n]); e != nil {
+				err = e
+			} else {
+				fb.lock.Lock()
+				if st.closed {
+					fb.lock.Unlock()
+					return
+				}
+				fb.appendData(&fileData{file: s, offset: off, size: int64(n)})
+				fb.lock.Unlock()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				st.err = err
+			}
+			return
+		}
+	}
+}
+
+//append d to the end of the tree, combine it with the last piece if possible
+func (fb *Buffer) appendData(d data) {
+	if fb.recording() {
+		fb.record(&edit{op: opInsert, off: fb.size(), size: d.Size(), tree: &Buffer{root: mkNode(d)}})
+	}
+	fb.root = splay(fb.root.last())
+	if c := fb.root.data.Combine(d); c != nil && !c.Appendable() {
+		fb.root.data = c
+		fb.root.resetSize()
+	} else {
+		fb.root.setRight(mkNode(d))
+	}
+}
+
+//the data of a stream, in memory or in a temporary file
+type spool struct {
+	lock   sync.RWMutex
+	mem    []byte
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+func (s *spool) Size() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.size
+}
+
+func (s *spool) append(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+	if s.file == nil && s.size+int64(len(b)) > spoolMemLimit {
+		f, err := os.CreateTemp("", "filebuf-spool-")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		if _, err := f.Write(s.mem); err != nil {
+			f.Close()
+			return err
+		}
+		s.file, s.mem = f, nil
+	}
+	if s.file != nil {
+		if _, err := s.file.WriteAt(b, s.size); err != nil {
+			return err
+		}
+	} else {
+		s.mem = append(s.mem, b...)
+	}
+	s.size += int64(len(b))
+	return nil
+}
+
+//let go of the memory and the temporary file
+func (s *spool) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.mem, s.closed = nil, true
+}
+
+func (s *spool) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	b := p
+	if int64(len(b)) > s.size-off {
+		b = b[:s.size-off]
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.ReadAt(b, off)
+	} else {
+		n = copy(b, s.mem[off:])
+	}
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
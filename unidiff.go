@@ -0,0 +1,495 @@
+package filebuf
+
+/* Unified diffs
+   UnifiedDiff turns the byte diff (see Diff) into line based hunks: every
+   changed range is widened to whole lines, ranges that touch are merged,
+   and lines that are the same at the ends of a range are left out again.
+   ApplyUnifiedDiff finds the hunks with a line index (the offsets where the
+   lines start), so looking up a line is a binary search. The index is made
+   with one scan of the buffer and dropped when the call returns, it isn't
+   kept between calls: that is 8 bytes a line. A hunk that isn't
+   at its line is looked for above and below it, up to maxHunkOffset lines
+   away, then with less context (fuzz), like patch(1) does. If any hunk fails, nothing is changed.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const noNewline = "\\ No newline at end of file\n"
+
+//how many lines above or below its line a hunk is looked for
+const maxHunkOffset = 1000
+
+//the offsets of the lines of a buffer
+type lineIndex struct {
+	bounds     []int64 //start of every line, and the size of the buffer
+	terminated bool    //the last line ends in a newline
+}
+
+func mkLineIndex(fb *Buffer) (*lineIndex, error) {
+	li := &lineIndex{bounds: []int64{0}}
+	var off int64
+	err := fb.iterRange(nil, 0, fb.size(), func(p []byte) bool {
+		for i, c := range p {
+			if c == '\n' {
+				li.bounds = append(li.bounds, off+int64(i)+1)
+			}
+		}
+		off += int64(len(p))
+		return false
+	})
+	if n := len(li.bounds); li.bounds[n-1] == fb.size() {
+		li.terminated = fb.size() > 0
+		li.bounds = li.bounds[:n-1]
+	}
+	li.bounds = append(li.bounds, fb.size())
+	return li, err
+}
+
+func (li *lineIndex) lines() int {
+	return len(li.bounds) - 1
+}
+
+//the line that holds off
+//the end of the buffer is on the last line, or on the line after it if that ends in a newline
+func (li *lineIndex) line(off int64) int {
+	n := li.lines()
+	if off >= li.bounds[n] && (n == 0 || li.terminated) {
+		return n
+	}
+	return sort.Search(n, func(i int) bool { return li.bounds[i] > off }) - 1
+}
+
+//line k of fb, with its newline
+func (li *lineIndex) text(fb *Buffer, k int) ([]byte, error) {
+	return fb.bytes(li.bounds[k], li.bounds[k+1]-li.bounds[k])
+}
+
+//lines [a0, a1) of a are replaced by lines [b0, b1) of b
+type lineChange struct {
+	a0, a1, b0, b1 int
+}
+
+//UnifiedDiff writes the differences between a and b to w as a unified diff,
+//with context lines around every change. Nothing is written if a and b are the same.
+func UnifiedDiff(w io.Writer, a, b *Buffer, nameA, nameB string, context int) error {
+	a, b = a.snapshot(), b.snapshot()
+	steps, err := diff(a, b)
+	if err != nil {
+		return err
+	}
+	la, err := mkLineIndex(a)
+	if err != nil {
+		return err
+	}
+	lb, err := mkLineIndex(b)
+	if err != nil {
+		return err
+	}
+	changes, err := lineChanges(steps, a, b, la, lb)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", nameA, nameB)
+	line := func(op byte, fb *Buffer, li *lineIndex, k int) error {
+		text, err := li.text(fb, k)
+		if err != nil {
+			return err
+		}
+		bw.WriteByte(op)
+		bw.Write(text)
+		if len(text) == 0 || text[len(text)-1] != '\n' {
+			bw.WriteString("\n" + noNewline)
+		}
+		return nil
+	}
+	for len(changes) > 0 {
+		//the changes that are close enough to share a hunk
+		n := 1
+		for n < len(changes) && changes[n].a0-changes[n-1].a1 <= 2*context {
+			n++
+		}
+		first, last := changes[0], changes[n-1]
+		//the lines between changes are the same in a and b
+		a0 := maxInt(first.a0-context, 0)
+		a1 := minInt(last.a1+context, la.lines())
+		b0, b1 := first.b0-(first.a0-a0), last.b1+(a1-last.a1)
+		fmt.Fprintf(bw, "@@ -%s +%s @@\n", hunkRange(a0, a1-a0), hunkRange(b0, b1-b0))
+
+		ka, kb := a0, b0
+		for _, c := range changes[:n] {
+			for ; ka < c.a0; ka, kb = ka+1, kb+1 {
+				if err := line(' ', a, la, ka); err != nil {
+					return err
+				}
+			}
+			for ; ka < c.a1; ka++ {
+				if err := line('-', a, la, ka); err != nil {
+					return err
+				}
+			}
+			for ; kb < c.b1; kb++ {
+				if err := line('+', b, lb, kb); err != nil {
+					return err
+				}
+			}
+		}
+		for ; ka < a1; ka++ {
+			if err := line(' ', a, la, ka); err != nil {
+				return err
+			}
+		}
+		changes = changes[n:]
+	}
+	return bw.Flush()
+}
+
+//start,count of a hunk header, lines counted from 1
+//an empty range starts at the line before it
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+//the changed lines of a diff
+func lineChanges(steps []DiffRange, a, b *Buffer, la, lb *lineIndex) ([]lineChange, error) {
+	//widen a changed byte range to lines: from the line it starts on
+	//through the line its end is on, those lines are the same in a and b
+	widen := func(li *lineIndex, start, end int64) (int, int) {
+		k := li.lines()
+		if end < li.bounds[k] {
+			k = li.line(end) + 1
+		}
+		return li.line(start), k
+	}
+	var changes []lineChange
+	add := func(a0, a1, b0, b1 int64) {
+		var c lineChange
+		c.a0, c.a1 = widen(la, a0, a1)
+		c.b0, c.b1 = widen(lb, b0, b1)
+		if n := len(changes); n > 0 && (c.a0 <= changes[n-1].a1 || c.b0 <= changes[n-1].b1) {
+			changes[n-1].a1, changes[n-1].b1 = c.a1, c.b1
+			return
+		}
+		changes = append(changes, c)
+	}
+	for _, c := range byteChanges(steps, a.size(), b.size()) {
+		add(c.a0, c.a1, c.b0, c.b1)
+	}
+
+	//leave out the lines that stayed the same
+	out := changes[:0]
+	for _, c := range changes {
+		for ; c.a0 < c.a1 && c.b0 < c.b1; c.a0, c.b0 = c.a0+1, c.b0+1 {
+			if same, err := sameLine(a, b, la, lb, c.a0, c.b0); err != nil {
+				return nil, err
+			} else if !same {
+				break
+			}
+		}
+		for ; c.a0 < c.a1 && c.b0 < c.b1; c.a1, c.b1 = c.a1-1, c.b1-1 {
+			if same, err := sameLine(a, b, la, lb, c.a1-1, c.b1-1); err != nil {
+				return nil, err
+			} else if !same {
+				break
+			}
+		}
+		if c.a0 < c.a1 || c.b0 < c.b1 {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func sameLine(a, b *Buffer, la, lb *lineIndex, ka, kb int) (bool, error) {
+	x, err := la.text(a, ka)
+	if err != nil {
+		return false, err
+	}
+	y, err := lb.text(b, kb)
+	return bytes.Equal(x, y), err
+}
+
+//HunkError is a hunk of a unified diff that doesn't apply
+type HunkError struct {
+	Hunk  int //number of the hunk in the diff, from 1
+	Line  int //line of its @@ header in the diff
+	Start int //the line it was meant for, from 1
+}
+
+func (e *HunkError) Error() string {
+	return fmt.Sprintf("filebuf: hunk #%d (line %d of the diff) doesn't apply at line %d", e.Hunk, e.Line, e.Start)
+}
+
+//HunkErrors are all the hunks of a unified diff that don't apply
+type HunkErrors []*HunkError
+
+func (e HunkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, h := range e {
+		msgs[i] = h.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+//a hunk of a unified diff
+type hunk struct {
+	line       int //of the @@ header
+	oldStart   int //from the header, counted from 1
+	oldLines   int
+	newLines   int
+	ops        []byte //' ', '-' or '+' for every line
+	text       [][]byte
+	oldN, newN int //lines read so far
+}
+
+//ApplyUnifiedDiff applies the unified diff read from r to fb
+//Hunks that aren't at the lines they say are looked for elsewhere, and with
+//up to fuzz lines of context less at either end. If a hunk can't be found,
+//fb is not changed at all and the error is HunkErrors with all failing hunks.
+func (fb *Buffer) ApplyUnifiedDiff(r io.Reader, fuzz int) error {
+	hunks, err := parseUnifiedDiff(r)
+	if err != nil {
+		return err
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	li, err := mkLineIndex(fb)
+	if err != nil {
+		return err
+	}
+
+	type edit struct {
+		off, size int64
+		text      []byte
+	}
+	var edits []edit
+	var failed HunkErrors
+	delta, next := 0, 0 //how far off the hunks are, the first line they may touch
+	for i, h := range hunks {
+		at, drop, err := fb.locate(li, h, delta, next, fuzz)
+		if err != nil {
+			return err
+		}
+		if at < 0 {
+			failed = append(failed, &HunkError{Hunk: i + 1, Line: h.line, Start: h.oldStart})
+			continue
+		}
+		want := h.oldStart - 1
+		if h.oldLines == 0 {
+			want++
+		}
+		delta = at - drop - want
+
+		ops, text := h.ops[drop:len(h.ops)-drop], h.text[drop:len(h.text)-drop]
+		k := at
+		var e *edit
+		for j, op := range ops {
+			if op == ' ' {
+				e = nil
+				k++
+				continue
+			}
+			if e == nil {
+				edits = append(edits, edit{off: li.bounds[k]})
+				e = &edits[len(edits)-1]
+			}
+			if op == '-' {
+				e.size += li.bounds[k+1] - li.bounds[k]
+				k++
+			} else {
+				e.text = append(e.text, text[j]...)
+			}
+		}
+		next = k
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		fb.remove(e.off, e.size)
+		if err := fb.insert(e.off, e.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//find the line where h applies, at or after line 'next'
+//returns the line and how many lines of context were dropped at both ends,
+//or -1 if it's nowhere
+func (fb *Buffer) locate(li *lineIndex, h *hunk, delta, next, fuzz int) (int, int, error) {
+	context := 0
+	for context < len(h.ops) && h.ops[context] == ' ' && h.ops[len(h.ops)-1-context] == ' ' {
+		context++
+	}
+	for drop := 0; drop <= fuzz && drop <= context; drop++ {
+		var old [][]byte
+		for j := drop; j < len(h.ops)-drop; j++ {
+			if h.ops[j] != '+' {
+				old = append(old, h.text[j])
+			}
+		}
+		want := h.oldStart - 1 + delta + drop
+		if h.oldLines == 0 {
+			want++
+		}
+		last := li.lines() - len(old)
+		//at the line it should be, then further and further away
+		for dist := 0; dist <= maxHunkOffset && (want-dist >= next || want+dist <= last); dist++ {
+			tries := []int{want - dist, want + dist}
+			if dist == 0 {
+				tries = tries[:1]
+			}
+			for _, at := range tries {
+				if at < next || at > last {
+					continue
+				}
+				ok, err := fb.linesAre(li, at, old)
+				if err != nil || ok {
+					return at, drop, err
+				}
+			}
+		}
+	}
+	return -1, 0, nil
+}
+
+//whether the lines from at on are lines
+func (fb *Buffer) linesAre(li *lineIndex, at int, lines [][]byte) (bool, error) {
+	for i, l := range lines {
+		k := at + i
+		if li.bounds[k+1]-li.bounds[k] != int64(len(l)) {
+			return false, nil
+		}
+		text, err := li.text(fb, k)
+		if err != nil || !bytes.Equal(text, l) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func parseUnifiedDiff(r io.Reader) ([]*hunk, error) {
+	br := bufio.NewReader(r)
+	var hunks []*hunk
+	var h *hunk
+	files := 0
+	for n := 1; ; n++ {
+		l, err := br.ReadBytes('\n')
+		if len(l) == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		bad := func(what string) error {
+			return fmt.Errorf("%w: line %d of the diff: %s", ErrBadPatch, n, what)
+		}
+		switch {
+		case bytes.HasPrefix(l, []byte("\\")):
+			//no newline at the end of the previous line
+			if h == nil || len(h.text) == 0 {
+				return nil, bad("misplaced '\\'")
+			}
+			last := h.text[len(h.text)-1]
+			h.text[len(h.text)-1] = bytes.TrimSuffix(last, []byte("\n"))
+		case h != nil && (h.oldN < h.oldLines || h.newN < h.newLines):
+			op := byte(' ')
+			if len(l) > 0 && l[0] != '\n' {
+				op, l = l[0], l[1:]
+			}
+			switch op {
+			case ' ':
+				h.oldN++
+				h.newN++
+			case '-':
+				h.oldN++
+			case '+':
+				h.newN++
+			default:
+				return nil, bad("expected a line of the hunk")
+			}
+			if h.oldN > h.oldLines || h.newN > h.newLines {
+				return nil, bad("hunk is longer than its header says")
+			}
+			h.ops = append(h.ops, op)
+			h.text = append(h.text, l)
+		case bytes.HasPrefix(l, []byte("--- ")):
+			if files++; files > 1 {
+				return nil, bad("the diff is for more than one file")
+			}
+		case bytes.HasPrefix(l, []byte("@@ ")):
+			var err error
+			if h, err = parseHunkHeader(l); err != nil {
+				return nil, bad(err.Error())
+			}
+			h.line = n
+			hunks = append(hunks, h)
+		}
+	}
+	if h != nil && (h.oldN < h.oldLines || h.newN < h.newLines) {
+		return nil, fmt.Errorf("%w: the last hunk is cut short", ErrBadPatch)
+	}
+	return hunks, nil
+}
+
+//"@@ -l,s +l,s @@ ..."
+func parseHunkHeader(l []byte) (*hunk, error) {
+	f := strings.Fields(string(l))
+	if len(f) < 4 || f[3] != "@@" || !strings.HasPrefix(f[1], "-") || !strings.HasPrefix(f[2], "+") {
+		return nil, fmt.Errorf("bad hunk header")
+	}
+	h := &hunk{}
+	var err error
+	if h.oldStart, h.oldLines, err = parseHunkRange(f[1][1:]); err != nil {
+		return nil, err
+	}
+	_, h.newLines, err = parseHunkRange(f[2][1:])
+	return h, err
+}
+
+func parseHunkRange(s string) (int, int, error) {
+	start, count := s, "1"
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		start, count = s[:i], s[i+1:]
+	}
+	l, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad hunk range %q", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || l < 0 || n < 0 {
+		return 0, 0, fmt.Errorf("bad hunk range %q", s)
+	}
+	return l, n, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,132 @@
+package filebuf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := NewMem([]byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"))
+	b := NewMem([]byte("a\nb\nC\nd\ne\nf\ng\ni\nj\nk"))
+	want := `--- a
++++ b
+@@ -2,3 +2,3 @@
+ b
+-c
++C
+ d
+@@ -7,4 +7,4 @@
+ g
+-h
+ i
+ j
++k
+\ No newline at end of file
+`
+	var out bytes.Buffer
+	if err := UnifiedDiff(&out, a, b, "a", "b", 1); err != nil {
+		t.Fatalf("TestUnifiedDiff: %v", err)
+	}
+	if out.String() != want {
+		t.Fatalf("TestUnifiedDiff: got\n%s\nwant\n%s", out.String(), want)
+	}
+
+	//random edits of random lines
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func(n int) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = fmt.Sprintf("line %d\n", rnd.Intn(20))
+		}
+		return l
+	}
+	for i := 0; i < 200; i++ {
+		x := randomLines(rnd.Intn(50))
+		y := append([]string{}, x...)
+		for j := rnd.Intn(5); j >= 0; j-- {
+			at := rnd.Intn(len(y) + 1)
+			del := rnd.Intn(len(y) - at + 1)
+			if del > 3 {
+				del = 3
+			}
+			y = append(y[:at], append(randomLines(rnd.Intn(3)), y[at+del:]...)...)
+		}
+		xs, ys := strings.Join(x, ""), strings.Join(y, "")
+		if rnd.Intn(4) == 0 {
+			xs = strings.TrimSuffix(xs, "\n")
+		}
+		if rnd.Intn(4) == 0 {
+			ys = strings.TrimSuffix(ys, "\n")
+		}
+		a, b := NewMem([]byte(xs)), NewMem([]byte(ys))
+		out.Reset()
+		if err := UnifiedDiff(&out, a, b, "x", "y", rnd.Intn(4)); err != nil {
+			t.Fatalf("TestUnifiedDiff: %v", err)
+		}
+		diff := out.String()
+		if err := a.ApplyUnifiedDiff(strings.NewReader(diff), 0); err != nil {
+			t.Fatalf("TestUnifiedDiff: %q to %q:\n%s\n%v", xs, ys, diff, err)
+		}
+		if got := string(readAll(a)); got != ys {
+			t.Fatalf("TestUnifiedDiff: %q to %q:\n%s\ngives %q", xs, ys, diff, got)
+		}
+	}
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+	orig := strings.Join(lines, "")
+	edited := strings.Replace(strings.Replace(orig, "line 20\n", "twenty\n", 1), "line 70\n", "seventy\n", 1)
+	var out bytes.Buffer
+	UnifiedDiff(&out, NewMem([]byte(orig)), NewMem([]byte(edited)), "orig", "edited", 3)
+	diff := out.String()
+	var failed HunkErrors
+
+	//the hunks moved down
+	fb := NewMem([]byte("new\nlines\n" + orig))
+	if err := fb.ApplyUnifiedDiff(strings.NewReader(diff), 0); err != nil {
+		t.Fatalf("TestApplyUnifiedDiff: with an offset: %v", err)
+	}
+	if got := string(readAll(fb)); got != "new\nlines\n"+edited {
+		t.Fatalf("TestApplyUnifiedDiff: with an offset gives %q", got)
+	}
+
+	//too far away to look for
+	far := strings.Repeat("x\n", maxHunkOffset+1) + orig
+	fb = NewMem([]byte(far))
+	if err := fb.ApplyUnifiedDiff(strings.NewReader(diff), 0); !errors.As(err, &failed) || len(failed) != 2 {
+		t.Fatalf("TestApplyUnifiedDiff: too far off: %v", err)
+	}
+
+	//the first line of context of the second hunk changed
+	changed := strings.Replace(orig, "line 67\n", "sixty seven\n", 1)
+	fb = NewMem([]byte(changed))
+	err := fb.ApplyUnifiedDiff(strings.NewReader(diff), 0)
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[0].Hunk != 2 || failed[0].Start != 68 {
+		t.Fatalf("TestApplyUnifiedDiff: without fuzz: %v", err)
+	}
+	if got := string(readAll(fb)); got != changed {
+		t.Fatal("TestApplyUnifiedDiff: a failed hunk changed the buffer")
+	}
+	if err := fb.ApplyUnifiedDiff(strings.NewReader(diff), 1); err != nil {
+		t.Fatalf("TestApplyUnifiedDiff: with fuzz: %v", err)
+	}
+	want := strings.Replace(edited, "line 67\n", "sixty seven\n", 1)
+	if got := string(readAll(fb)); got != want {
+		t.Fatalf("TestApplyUnifiedDiff: with fuzz gives %q", got)
+	}
+
+	//malformed
+	for _, d := range []string{"@@ -1,2 +1,2 @@\n a\n", "@@ -x +1 @@\n", "--- a\n+++ b\n@@ -1 +1 @@\n-a\n+b\n--- c\n"} {
+		if err := NewMem([]byte("a\nb\n")).ApplyUnifiedDiff(strings.NewReader(d), 0); !errors.Is(err, ErrBadPatch) {
+			t.Errorf("TestApplyUnifiedDiff: %q gives %v", d, err)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package filebuf
+
+/* VCDIFF patches (RFC 3284)
+   A header and a list of windows. Every window builds a part of the target
+   with instructions: ADD new bytes, RUN a repeated byte, or COPY from the
+   source segment (a range of the source or of the target so far) or from
+   the window itself. Addresses are coded through a small cache of recent
+   ones, instructions through a code table.
+   Only the default code table is supported and no secondary compression.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+)
+
+var vcdMagic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+const (
+	//header indicator
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	//window indicator
+	vcdSource   = 0x01
+	vcdTarget   = 0x02
+	vcdChecksum = 0x04
+
+	//instruction types
+	vcdNoop = 0
+	vcdAdd  = 1
+	vcdRun  = 2
+	vcdCopy = 3
+
+	//address cache
+	vcdNear = 4
+	vcdSame = 3
+
+	//target size of the windows MakePatch writes
+	vcdWindowSize = 16 << 20
+	//shortest run that becomes a RUN
+	vcdMinRun = 16
+)
+
+type vcdInst struct {
+	typ, size, mode byte
+}
+
+//the default code table, RFC 3284 section 5.6
+var vcdDefaultTable = func() (t [256][2]vcdInst) {
+	i := 0
+	t[i][0] = vcdInst{typ: vcdRun}
+	i++
+	for size := 0; size <= 17; size++ {
+		t[i][0] = vcdInst{typ: vcdAdd, size: byte(size)}
+		i++
+	}
+	for mode := 0; mode < 2+vcdNear+vcdSame; mode++ {
+		t[i][0] = vcdInst{typ: vcdCopy, mode: byte(mode)}
+		i++
+		for size := 4; size <= 18; size++ {
+			t[i][0] = vcdInst{typ: vcdCopy, size: byte(size), mode: byte(mode)}
+			i++
+		}
+	}
+	for mode := 0; mode < 2+vcdNear+vcdSame; mode++ {
+		for add := 1; add <= 4; add++ {
+			copies := []int{4, 5, 6}
+			if mode >= 2+vcdNear {
+				copies = []int{4}
+			}
+			for _, size := range copies {
+				t[i][0] = vcdInst{typ: vcdAdd, size: byte(add)}
+				t[i][1] = vcdInst{typ: vcdCopy, size: byte(size), mode: byte(mode)}
+				i++
+			}
+		}
+	}
+	for mode := 0; mode < 2+vcdNear+vcdSame; mode++ {
+		t[i][0] = vcdInst{typ: vcdCopy, size: 4, mode: byte(mode)}
+		t[i][1] = vcdInst{typ: vcdAdd, size: 1}
+		i++
+	}
+	return
+}()
+
+//the address cache, RFC 3284 section 5.1
+type vcdCache struct {
+	near [vcdNear]int64
+	next int
+	same [vcdSame * 256]int64
+}
+
+func (c *vcdCache) decode(r *bytes.Reader, mode byte, here int64) (int64, error) {
+	var a int64
+	var err error
+	switch {
+	case mode == 0: //SELF
+		a, err = vcdInt(r)
+	case mode == 1: //HERE
+		a, err = vcdInt(r)
+		a = here - a
+	case mode < 2+vcdNear:
+		a, err = vcdInt(r)
+		a += c.near[mode-2]
+	default:
+		var m byte
+		m, err = patchByte(r)
+		a = c.same[int(mode-2-vcdNear)*256+int(m)]
+	}
+	if err != nil {
+		return 0, err
+	}
+	if a < 0 || a >= here {
+		return 0, fmt.Errorf("%w: copy address %d at %d", ErrBadPatch, a, here)
+	}
+	c.near[c.next] = a
+	c.next = (c.next + 1) % vcdNear
+	c.same[a%(vcdSame*256)] = a
+	return a, nil
+}
+
+func applyVCDIFF(orig *Buffer, r io.Reader) (*Buffer, error) {
+	br := bufio.NewReader(r)
+	magic, err := patchBytes(br, 4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, vcdMagic) {
+		return nil, fmt.Errorf("%w: not a VCDIFF patch", ErrBadPatch)
+	}
+	ind, err := patchByte(br)
+	if err != nil {
+		return nil, err
+	}
+	if ind&(vcdDecompress|vcdCodeTable) != 0 {
+		return nil, fmt.Errorf("%w: secondary compression and code tables are not supported", ErrBadPatch)
+	}
+	if ind&vcdAppHeader != 0 {
+		n, err := vcdInt(br)
+		if err == nil {
+			_, err = patchBytes(br, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b := mkBuilder()
+	for {
+		ind, err := br.ReadByte()
+		if err == io.EOF {
+			return b.out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := vcdWindow(b, orig, br, ind); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//decode the window with indicator ind
+func vcdWindow(b *builder, orig *Buffer, r *bufio.Reader, ind byte) error {
+	var src *Buffer
+	var srcLen, srcPos int64
+	switch ind & (vcdSource | vcdTarget) {
+	case vcdSource:
+		src = orig
+	case vcdTarget:
+		src = b.out
+	case vcdSource | vcdTarget:
+		return fmt.Errorf("%w: window with a source and a target segment", ErrBadPatch)
+	}
+	var ints [6]int64
+	nints := 0
+	if src != nil {
+		nints = 2
+	}
+	for i := 0; i < nints+2; i++ {
+		var err error
+		if ints[i], err = vcdInt(r); err != nil {
+			return err
+		}
+	}
+	if src != nil {
+		srcLen, srcPos = ints[0], ints[1]
+		if srcPos+srcLen > src.size() {
+			return fmt.Errorf("%w: source segment [%d, %d) of %d bytes", ErrBadPatch, srcPos, srcPos+srcLen, src.size())
+		}
+	}
+	tgtLen := ints[nints+1]
+	deltaInd, err := patchByte(r)
+	if err != nil {
+		return err
+	}
+	if deltaInd != 0 {
+		return fmt.Errorf("%w: secondary compression is not supported", ErrBadPatch)
+	}
+	var lens [3]int64
+	for i := range lens {
+		if lens[i], err = vcdInt(r); err != nil {
+			return err
+		}
+	}
+	var sum []byte
+	if ind&vcdChecksum != 0 {
+		if sum, err = patchBytes(r, 4); err != nil {
+			return err
+		}
+	}
+	var sections [3][]byte
+	for i, n := range lens {
+		if sections[i], err = patchBytes(r, n); err != nil {
+			return err
+		}
+	}
+	data := bytes.NewReader(sections[0])
+	inst := bytes.NewReader(sections[1])
+	addr := bytes.NewReader(sections[2])
+
+	start := b.size()
+	var cache vcdCache
+	for inst.Len() > 0 {
+		code, _ := inst.ReadByte()
+		for _, in := range vcdDefaultTable[code] {
+			if in.typ == vcdNoop {
+				continue
+			}
+			size := int64(in.size)
+			if size == 0 {
+				if size, err = vcdInt(inst); err != nil {
+					return err
+				}
+			}
+			if b.size()-start+size > tgtLen {
+				return fmt.Errorf("%w: window is longer than %d bytes", ErrBadPatch, tgtLen)
+			}
+			switch in.typ {
+			case vcdAdd:
+				var p []byte
+				p, err = patchBytes(data, size)
+				b.add(p)
+			case vcdRun:
+				var c byte
+				c, err = patchByte(data)
+				b.fill([]byte{c}, size)
+			case vcdCopy:
+				var a int64
+				here := srcLen + b.size() - start
+				if a, err = cache.decode(addr, in.mode, here); err != nil {
+					return err
+				}
+				if a < srcLen {
+					//from the source segment, maybe running on into the window
+					n := minInt64(size, srcLen-a)
+					if err = b.copy(src, srcPos+a, n); err == nil && n < size {
+						err = b.copySelf(start, size-n)
+					}
+				} else {
+					err = b.copySelf(start+a-srcLen, size)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if b.size()-start != tgtLen {
+		return fmt.Errorf("%w: window of %d bytes, expected %d", ErrBadPatch, b.size()-start, tgtLen)
+	}
+	if sum != nil {
+		h := adler32.New()
+		if err := b.out.iterRange(nil, start, b.size(), func(p []byte) bool {
+			h.Write(p)
+			return false
+		}); err != nil {
+			return err
+		}
+		if h.Sum32() != binary.BigEndian.Uint32(sum) {
+			return fmt.Errorf("%w: window checksum mismatch", ErrBadPatch)
+		}
+	}
+	return nil
+}
+
+//VCDIFF's integers: big endian, 7 bits per byte, the top bit means more follow
+func vcdInt(r io.ByteReader) (int64, error) {
+	var v int64
+	for i := 0; i < 9; i++ {
+		c, err := patchByte(r)
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | int64(c&0x7f)
+		if c&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: integer too large", ErrBadPatch)
+}
+
+func appendVcdInt(b []byte, v int64) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+//writes windows with the whole of old as the source segment
+//and COPYs with absolute addresses
+type vcdWriter struct {
+	out              bytes.Buffer
+	srcLen           int64
+	tgtLen           int64
+	data, inst, addr []byte
+}
+
+func makeVCDIFF(old, new *Buffer, steps []DiffRange) ([]byte, error) {
+	w := &vcdWriter{srcLen: old.size()}
+	w.out.Write(vcdMagic)
+	w.out.WriteByte(0)
+	for _, st := range steps {
+		switch st.Op {
+		case DiffEqual:
+			for off := int64(0); off < st.Size; {
+				n := minInt64(st.Size-off, vcdWindowSize-w.tgtLen)
+				if n < 4 {
+					//too short to be a COPY
+					p, err := new.bytes(st.B+off, n)
+					if err != nil {
+						return nil, err
+					}
+					w.add(p)
+				} else {
+					w.copy(st.A+off, n)
+				}
+				off += n
+				w.full()
+			}
+		case DiffInsert:
+			for off := int64(0); off < st.Size; {
+				n := minInt64(st.Size-off, minInt64(vcdWindowSize-w.tgtLen, 1<<20))
+				p, err := new.bytes(st.B+off, n)
+				if err != nil {
+					return nil, err
+				}
+				w.add(p)
+				off += n
+				w.full()
+			}
+		}
+	}
+	w.flush()
+	return w.out.Bytes(), nil
+}
+
+//start a new window when this one is big enough
+func (w *vcdWriter) full() {
+	if w.tgtLen >= vcdWindowSize {
+		w.flush()
+	}
+}
+
+func (w *vcdWriter) flush() {
+	if w.tgtLen == 0 {
+		return
+	}
+	var delta []byte
+	delta = appendVcdInt(delta, w.tgtLen)
+	delta = append(delta, 0)
+	delta = appendVcdInt(delta, int64(len(w.data)))
+	delta = appendVcdInt(delta, int64(len(w.inst)))
+	delta = appendVcdInt(delta, int64(len(w.addr)))
+	delta = append(append(append(delta, w.data...), w.inst...), w.addr...)
+
+	var hdr []byte
+	if w.srcLen > 0 {
+		hdr = append(hdr, vcdSource)
+		hdr = appendVcdInt(hdr, w.srcLen)
+		hdr = appendVcdInt(hdr, 0)
+	} else {
+		hdr = append(hdr, 0)
+	}
+	hdr = appendVcdInt(hdr, int64(len(delta)))
+	w.out.Write(hdr)
+	w.out.Write(delta)
+	w.tgtLen = 0
+	w.data, w.inst, w.addr = w.data[:0], w.inst[:0], w.addr[:0]
+}
+
+//COPY in mode SELF
+func (w *vcdWriter) copy(addr, n int64) {
+	if n <= 18 {
+		w.inst = append(w.inst, byte(n+16))
+	} else {
+		w.inst = appendVcdInt(append(w.inst, 19), n)
+	}
+	w.addr = appendVcdInt(w.addr, addr)
+	w.tgtLen += n
+}
+
+//ADD p, with RUNs for long runs
+func (w *vcdWriter) add(p []byte) {
+	for len(p) > 0 {
+		run := 1
+		for run < len(p) && p[run] == p[0] {
+			run++
+		}
+		if run >= vcdMinRun {
+			w.inst = appendVcdInt(append(w.inst, 0), int64(run))
+			w.data = append(w.data, p[0])
+			w.tgtLen += int64(run)
+			p = p[run:]
+			continue
+		}
+		end := runStart(p, vcdMinRun)
+		if end <= 17 {
+			w.inst = append(w.inst, byte(end+1))
+		} else {
+			w.inst = appendVcdInt(append(w.inst, 1), int64(end))
+		}
+		w.data = append(w.data, p[:end]...)
+		w.tgtLen += int64(end)
+		p = p[end:]
+	}
+}
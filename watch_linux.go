@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package filebuf
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+//watches the backing files of a buffer with inotify
+type watcher struct {
+	file *os.File
+	fd   int
+}
+
+const watchMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVE_SELF | syscall.IN_DELETE_SELF
+
+//Watch calls cb with the result of CheckBacking whenever one of the backing
+//files of fb is changed on disk, until Unwatch is called.
+//cb is called from another goroutine.
+func (fb *Buffer) Watch(cb func(err error)) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.watcher != nil {
+		return errors.New("filebuf: buffer is already watched")
+	}
+	if len(fb.backing) == 0 {
+		return errors.New("filebuf: buffer has no backing file to watch")
+	}
+	//a non-blocking fd makes os.File use the poller, so Close interrupts Read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	w := &watcher{file: os.NewFile(uintptr(fd), "inotify"), fd: fd}
+	if err := w.add(fb.backing); err != nil {
+		w.file.Close()
+		return err
+	}
+	fb.watcher = w
+	go w.run(fb, cb)
+	return nil
+}
+
+//Unwatch stops watching the backing files of fb
+func (fb *Buffer) Unwatch() {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.watcher != nil {
+		fb.watcher.file.Close()
+		fb.watcher = nil
+	}
+}
+
+//watch these backing files (too)
+func (w *watcher) add(backing []*backing) error {
+	for _, b := range backing {
+		if _, err := syscall.InotifyAddWatch(w.fd, b.path, watchMask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *watcher) run(fb *Buffer, cb func(error)) {
+	buf := make([]byte, 4096)
+	for {
+		//we don't care what happened exactly, CheckBacking will tell
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		if err := fb.CheckBacking(); err != nil {
+			cb(err)
+		}
+	}
+}
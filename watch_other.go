@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package filebuf
+
+import "errors"
+
+//watching files is only implemented on linux (inotify)
+type watcher struct{}
+
+//Watch calls cb with the result of CheckBacking whenever one of the backing
+//files of fb is changed on disk, until Unwatch is called.
+//This is not supported on this platform, use CheckBacking instead.
+func (fb *Buffer) Watch(cb func(err error)) error {
+	return errors.New("filebuf: watching files is not supported on this platform")
+}
+
+//Unwatch stops watching the backing files of fb
+func (fb *Buffer) Unwatch() {}
+
+func (w *watcher) add(backing []*backing) error {
+	return nil
+}